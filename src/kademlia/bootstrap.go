@@ -0,0 +1,99 @@
+package kademlia
+
+// Contains the join procedure a node runs to enter the network.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoSeed is returned by Bootstrap when none of the seeds answered.
+var ErrNoSeed = errors.New("no seed answered")
+
+// Join the network through seeds, given as "host:port" strings. Following the
+// Kademlia join protocol, we ping the seeds (which adds them to our buckets),
+// look up our own ID, and then refresh every bucket further away than our
+// closest neighbour.
+func (k *Kademlia) Bootstrap(ctx context.Context, seeds ...string) error {
+	answered := 0
+	var lastErr error = errors.New("no seed given")
+	for _, seed := range seeds {
+		host, port, err := ParseHostAndPort(seed)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		contact, err := k.DoPing(ctx, host, port)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if contact.NodeID == k.NodeID { // we were given our own address
+			lastErr = errors.New(seed + " is this node")
+			continue
+		}
+		answered++
+	}
+	if answered == 0 {
+		return fmt.Errorf("%w: %v", ErrNoSeed, lastErr)
+	}
+	return k.join(ctx)
+}
+
+// Rejoin the network through the contacts saved in our data directory by a
+// previous run, without needing a seed. It fails with ErrNoSeed when none
+// of them answers.
+func (k *Kademlia) Rejoin(ctx context.Context) error {
+	if len(k.savedContacts) == 0 {
+		return fmt.Errorf("%w: no saved contacts", ErrNoSeed)
+	}
+	// ping them alpha at a time; the ones which answer go back into our
+	// buckets
+	var answered int32
+	sem := make(chan struct{}, alpha)
+	var wg sync.WaitGroup
+	for _, c := range k.savedContacts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(c Contact) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			pingCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+			defer cancel()
+			if contact, err := k.DoPing(pingCtx, c.Host, c.Port); err == nil && contact.NodeID == c.NodeID {
+				atomic.AddInt32(&answered, 1)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctxError(ctx)
+	}
+	if answered == 0 {
+		return fmt.Errorf("%w: none of %v saved contacts", ErrNoSeed, len(k.savedContacts))
+	}
+	return k.join(ctx)
+}
+
+// The end of the join protocol, once some nodes are in our buckets.
+func (k *Kademlia) join(ctx context.Context) error {
+	closest := k.DoIterativeFindNode_Internal(ctx, k.NodeID)
+	if ctx.Err() != nil {
+		return ctxError(ctx)
+	}
+	if len(closest) == 0 {
+		return nil
+	}
+	for i := GetBucketIndex(k.NodeID.Xor(closest[0].NodeID)) + 1; i < b; i++ {
+		k.RefreshBucket(ctx, i)
+		if ctx.Err() != nil {
+			return ctxError(ctx)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := NewRandomID()
+	for i := 0; i < b; i++ {
+		id := RandomIDInBucket(self, i)
+		if v := GetBucketIndex(self.Xor(id)); v != i {
+			t.Errorf("Was %v, but expected %v", v, i)
+		}
+	}
+}
+
+// Whether node has heard of id: in a full bucket a newcomer rightly goes to
+// the replacement cache rather than Contacts.
+func heardOf(node *Kademlia, id ID) bool {
+	bucket := &node.Buckets[GetBucketIndex(node.NodeID.Xor(id))]
+	bucket.Locker.Lock()
+	defer bucket.Locker.Unlock()
+	for _, contacts := range [][]Contact{bucket.Contacts, bucket.Replacements} {
+		for _, c := range contacts {
+			if c.NodeID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestBootstrap(t *testing.T) {
+	network := NewMemNetwork()
+	seed, _ := network.NewKademlia("127.0.0.1:0")
+	seedAddr := HostAndPortString(seed.SelfContact.Host, seed.SelfContact.Port)
+	nodes := []*Kademlia{seed}
+	for i := 0; i < 30; i++ {
+		node, _ := network.NewKademlia("127.0.0.1:0")
+		if err := node.Bootstrap(context.Background(), seedAddr); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	last := nodes[len(nodes)-1]
+	known := 0
+	for i := range last.Buckets {
+		known += len(last.Buckets[i].Contacts)
+	}
+	if known < k {
+		t.Errorf("the last node knows %v nodes after joining, expected at least %v", known, k)
+	}
+	if !heardOf(seed, last.NodeID) {
+		t.Error("the seed never heard of the last node")
+	}
+	// everyone the last node asked during its join learned it
+	knownBy := 0
+	for _, node := range nodes[:len(nodes)-1] {
+		if heardOf(node, last.NodeID) {
+			knownBy++
+		}
+	}
+	if knownBy < k {
+		t.Errorf("%v nodes know the last node after it joined, expected at least %v", knownBy, k)
+	}
+}
+
+func TestBootstrapNoSeed(t *testing.T) {
+	network := NewMemNetwork()
+	node, _ := network.NewKademlia("127.0.0.1:0")
+	self := HostAndPortString(node.SelfContact.Host, node.SelfContact.Port)
+	err := node.Bootstrap(context.Background(), "127.0.0.1:9", self)
+	if !errors.Is(err, ErrNoSeed) {
+		t.Errorf("Was %v, but expected %v", err, ErrNoSeed)
+	}
+}
@@ -0,0 +1,85 @@
+package kademlia
+
+// Contains the error kinds returned by the client API. Callers tell them
+// apart with errors.Is, e.g. errors.Is(err, ErrUnreachable).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+)
+
+var (
+	// ErrUnreachable is returned when the peer could not be contacted.
+	ErrUnreachable = errors.New("peer unreachable")
+	// ErrTimeout is returned when the peer did not answer in time, or the
+	// caller's deadline passed.
+	ErrTimeout = errors.New("timed out")
+	// ErrNotFound is returned when a contact, value or VDO does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrRemote is returned when the peer answered with an error.
+	ErrRemote = errors.New("remote error")
+	// ErrQuorum is returned when too few nodes acknowledged a replicated
+	// operation.
+	ErrQuorum = errors.New("quorum not reached")
+	// ErrConflict is returned when the copies of a value disagree and no
+	// resolver could pick one.
+	ErrConflict = errors.New("conflicting values")
+)
+
+// An RPCError records which call to which peer failed. Kind is one of the
+// Err* values above; Err is the underlying cause.
+type RPCError struct {
+	Op   string
+	Peer string
+	Kind error
+	Err  error
+}
+
+func (e *RPCError) Error() string {
+	return e.Op + " " + e.Peer + ": " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RPCError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func newRPCError(op string, peer string, kind error, err error) error {
+	return &RPCError{op, peer, kind, err}
+}
+
+// Pick the error kind matching a failed dial or call made under ctx. A
+// cancelled ctx keeps context.Canceled as its kind.
+func errorKind(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return context.Canceled
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return ErrRemote
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	return ErrUnreachable
+}
+
+// Return the error for an operation given up because ctx is done. A passed
+// deadline is an ErrTimeout, as for a single RPC; a cancellation is returned
+// as is.
+func ctxError(ctx context.Context) error {
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package kademlia
+
+// Contains a crash-safe on-disk ValueStore. Every Put and Delete is appended
+// to a log and synced before it returns; opening the store replays the log.
+// A record torn by a crash fails its checksum and is cut off, along with
+// anything after it. Once most of the log is dead records, it is compacted
+// by writing the live values to a new file and renaming it over the old one.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logHeaderSize   = 8       // payload length, then CRC-32 of the payload
+	maxRecordSize   = 1 << 26 // anything bigger is garbage
+	compactMinCount = 1024    // never compact logs shorter than this
+)
+
+type logRecord struct {
+	Delete bool
+	Key    ID
+	Value  StoredValue
+}
+
+type FileValueStore struct {
+	Locker  *sync.Mutex
+	Values  map[ID]StoredValue
+	path    string
+	file    *os.File
+	records int // records in the log, live or dead
+}
+
+// Open the store logged at path, creating it if needed.
+func NewFileValueStore(path string) (*FileValueStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileValueStore{Locker: &sync.Mutex{}, Values: make(map[ID]StoredValue), path: path, file: f}
+	end, err := s.replay()
+	if err == nil {
+		// drop a torn tail so new records follow the last good one
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Apply every good record in the log, and return where the good part ends.
+func (s *FileValueStore) replay() (int64, error) {
+	r := bufio.NewReader(s.file)
+	var end int64
+	header := make([]byte, logHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return end, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			return end, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return end, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return end, nil
+		}
+		var rec logRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return end, nil
+		}
+		if rec.Delete {
+			delete(s.Values, rec.Key)
+		} else {
+			s.Values[rec.Key] = rec.Value
+		}
+		s.records++
+		end += int64(logHeaderSize + len(payload))
+	}
+}
+
+func encodeRecord(rec logRecord) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, logHeaderSize, logHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(frame, payload.Bytes()...), nil
+}
+
+// Append rec to the log and sync it. Must be called with Locker held.
+func (s *FileValueStore) append(rec logRecord) error {
+	if s.file == nil {
+		return errors.New("value store is closed")
+	}
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(frame); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// Rewrite the log with only the live values once it is mostly dead records.
+// Must be called with Locker held.
+func (s *FileValueStore) maybeCompact() error {
+	if s.records < compactMinCount || s.records < 2*len(s.Values) {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, sv := range s.Values {
+		frame, err := encodeRecord(logRecord{Key: key, Value: sv})
+		if err == nil {
+			_, err = w.Write(frame)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.file.Close()
+	s.file = f
+	s.records = len(s.Values)
+	return nil
+}
+
+func (s *FileValueStore) Put(key ID, sv StoredValue) error {
+	s.Locker.Lock()
+	defer s.Locker.Unlock()
+	if err := s.append(logRecord{Key: key, Value: sv}); err != nil {
+		return err
+	}
+	s.Values[key] = sv
+	return s.maybeCompact()
+}
+
+func (s *FileValueStore) Get(key ID) (StoredValue, bool, error) {
+	s.Locker.Lock()
+	sv, ok := s.Values[key]
+	s.Locker.Unlock()
+	return sv, ok, nil
+}
+
+func (s *FileValueStore) Delete(key ID) error {
+	s.Locker.Lock()
+	defer s.Locker.Unlock()
+	if _, ok := s.Values[key]; !ok {
+		return nil
+	}
+	if err := s.append(logRecord{Delete: true, Key: key}); err != nil {
+		return err
+	}
+	delete(s.Values, key)
+	return s.maybeCompact()
+}
+
+func (s *FileValueStore) Iterate(fn func(key ID, sv StoredValue) bool) error {
+	s.Locker.Lock()
+	defer s.Locker.Unlock()
+	for key, sv := range s.Values {
+		if !fn(key, sv) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *FileValueStore) Close() error {
+	s.Locker.Lock()
+	defer s.Locker.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
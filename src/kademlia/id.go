@@ -78,6 +78,26 @@ func NewRandomID() (ret ID) {
 	return
 }
 
+// Generate a random ID whose distance from id falls in bucket index, i.e.
+// whose highest differing bit is bit index counting from the low-order end.
+func RandomIDInBucket(id ID, index int) (ret ID) {
+	distance := NewRandomID()
+	top := IDBits - 1 - index // position of the bit, counting from the front
+	for i := 0; i < IDBytes; i++ {
+		for j := 0; j < 8; j++ {
+			pos := 8*i + j
+			mask := uint8(0x80) >> uint8(j)
+			switch {
+			case pos < top:
+				distance[i] &^= mask
+			case pos == top:
+				distance[i] |= mask
+			}
+		}
+	}
+	return id.Xor(distance)
+}
+
 // Generate an ID identical to another.
 func CopyID(id ID) (ret ID) {
 	for i := 0; i < IDBytes; i++ {
@@ -1,393 +1,376 @@
 package kademlia
 
+// Contains the lookup engine shared by iterativeFindNode and
+// iterativeFindValue, and the iterative operations built on it.
+
 import (
-	"container/heap"
-	"errors"
+	"context"
 	"fmt"
-	//"net"
-	//"net/http"
-	"log"
-	"net/rpc"
+	"sort"
 	"sync"
 	"time"
 )
 
-type ShortList struct { // implemented through a heap
-	Contacts    []Contact
-	Id          ID
-	Locker      *sync.Mutex
-	LookUpTable map[string]bool // actually a hash set
+const (
+	// deadline for each FIND_NODE/FIND_VALUE sent during a lookup
+	lookupRPCTimeout = time.Second
+	// a cached copy lives at least ExpireInterval/2^maxCacheHalvings
+	maxCacheHalvings = 16
+)
+
+// Where a candidate is in a lookup.
+type candidateState int
+
+const (
+	candidateUnqueried candidateState = iota
+	candidateQueried                  // RPC in flight
+	candidateResponded
+	candidateFailed
+)
+
+type lookupCandidate struct {
+	Contact Contact
+	State   candidateState
+	RTT     time.Duration // as measured by us when it was added; zero if never
 }
 
-func (sl ShortList) Len() int { return len(sl.Contacts) }
-func (sl ShortList) Less(i, j int) bool {
-	dist1 := sl.Id.Xor(sl.Contacts[i].NodeID)
-	dist2 := sl.Id.Xor(sl.Contacts[j].NodeID)
-	flag := dist1.Compare(dist2)
-	return flag == -1
+// What a single FIND_NODE/FIND_VALUE of a lookup brought back.
+type lookupReply struct {
+	Contact     Contact
+	Nodes       []Contact
+	Value       []byte
+	Publisher   ID
+	PublishedAt time.Time
+	Err         error
 }
-func (sl ShortList) Swap(i, j int) {
-	sl.Contacts[i], sl.Contacts[j] = sl.Contacts[j], sl.Contacts[i]
+
+// A lookup for Target. Candidates holds every contact seen so far, sorted by
+// distance to Target; Seen indexes them by ID so nobody is added twice.
+// A FindValue lookup collects values into Found until Quorum nodes have sent
+// one. A lookup is only used by the goroutine running it.
+type lookup struct {
+	kadem      *Kademlia
+	Target     ID
+	FindValue  bool
+	Quorum     int
+	Found      []lookupReply
+	Candidates []*lookupCandidate
+	Seen       map[ID]*lookupCandidate
 }
 
-func (sl *ShortList) Push(x interface{}) {
-	_, ok := sl.LookUpTable[x.(Contact).NodeID.AsString()]
-	if !ok {
-		sl.LookUpTable[x.(Contact).NodeID.AsString()] = true
-		sl.Contacts = append(sl.Contacts, x.(Contact))
+func (K *Kademlia) newLookup(target ID, findValue bool) *lookup {
+	l := &lookup{kadem: K, Target: target, FindValue: findValue, Quorum: 1}
+	l.Seen = make(map[ID]*lookupCandidate)
+	K.touchBucket(GetBucketIndex(K.NodeID.Xor(target)))
+	for _, c := range K.InitAlphaNodes(target) {
+		l.add(c)
 	}
+	return l
 }
 
-func (sl *ShortList) Pop() interface{} {
-	old := sl.Contacts
-	n := len(old)
-	x := old[n-1]
-	sl.Contacts = old[0 : n-1]
-	delete(sl.LookUpTable, x.NodeID.AsString())
+// Return the k contacts from our own buckets closest to id.
+func (K *Kademlia) InitAlphaNodes(id ID) []Contact {
+	return FindKClosestContacts(K, id, K.NodeID)
+}
 
-	return x
+// Sort contacts by XOR distance to target, closest first.
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return target.Xor(contacts[i].NodeID).Less(target.Xor(contacts[j].NodeID))
+	})
 }
 
-func (K *Kademlia) InitAlphaNodes(id ID) *ShortList {
-	// create an empty heap
-	h := &ShortList{}
-	h.Id = id
-	h.LookUpTable = make(map[string]bool)
-	h.Locker = &sync.Mutex{}
-	heap.Init(h)
-	raw_contacts := make([]Contact, 0, 160*k)
-	// push every contact in kademlia's node into it
-	for i := 0; i < 160; i++ {
-		raw_contacts = append(raw_contacts, K.Buckets[i].Contacts...)
-		//fmt.Printf("%v, %v\n", i, len(K.Buckets[i].Contacts))
+// Add a contact to the candidates, unless it is ourselves or already known.
+func (l *lookup) add(c Contact) {
+	if c.NodeID == l.kadem.NodeID {
+		return
 	}
-	tmp := &ShortList{}
-	tmp.Id = id
-	tmp.LookUpTable = make(map[string]bool)
-	tmp.Contacts = raw_contacts
-	heap.Init(tmp)
+	if _, ok := l.Seen[c.NodeID]; ok {
+		return
+	}
+	cand := &lookupCandidate{c, candidateUnqueried, l.kadem.rttOf(c.NodeID)}
+	l.Seen[c.NodeID] = cand
+	dist := l.Target.Xor(c.NodeID)
+	i := sort.Search(len(l.Candidates), func(i int) bool {
+		return dist.Less(l.Target.Xor(l.Candidates[i].Contact.NodeID))
+	})
+	l.Candidates = append(l.Candidates, nil)
+	copy(l.Candidates[i+1:], l.Candidates[i:])
+	l.Candidates[i] = cand
+}
 
-	for j := 0; j < alpha; j++ {
-		if tmp.Len() > 0 {
-			tmpNode := heap.Pop(tmp)
-			heap.Push(h, tmpNode.(Contact))
-		} else {
+// The closest candidate nobody has asked yet among the k closest candidates
+// which have not failed, or nil when all of those have been asked.
+//
+// In LatencyAware mode, candidates as far from Target as the closest one
+// (in the same bucket of Target) count as equally close, and the fastest of
+// them is picked. This only changes the order in which the k closest are
+// asked, so the lookup still ends with the same result.
+func (l *lookup) next() *lookupCandidate {
+	live := 0
+	var best *lookupCandidate
+	bestBucket := 0
+	for _, cand := range l.Candidates {
+		if live == k {
 			break
 		}
+		switch cand.State {
+		case candidateFailed:
+			continue
+		case candidateUnqueried:
+			if !l.kadem.LatencyAware {
+				return cand
+			}
+			bucket := GetBucketIndex(l.Target.Xor(cand.Contact.NodeID))
+			switch {
+			case best == nil:
+				best, bestBucket = cand, bucket
+			case bucket != bestBucket: // candidates are sorted, so farther
+				return best
+			case cand.fasterThan(best):
+				best = cand
+			}
+		}
+		live++
 	}
-
-	// add closed alpha nodes to the heap
-	return h
+	return best
 }
 
-func (k *Kademlia) GetAlphaNodes(sl *ShortList) (NodesToPing []Contact, err error) {
-	if sl.Len() == 0 {
-		err = errors.New("Cannot find any node")
-		return
+// Whether c answered faster than other; a measured RTT beats none.
+func (c *lookupCandidate) fasterThan(other *lookupCandidate) bool {
+	if c.RTT == 0 {
+		return false
 	}
-	NodesToPing = make([]Contact, 0, alpha)
-	for i := 0; i < alpha; i++ {
-		if sl.Len() == 0 {
+	return other.RTT == 0 || c.RTT < other.RTT
+}
+
+// Up to n of the closest candidates which answered, closest first.
+func (l *lookup) responded(n int) []Contact {
+	contacts := make([]Contact, 0, n)
+	for _, cand := range l.Candidates {
+		if len(contacts) == n {
 			break
 		}
-		tmpNode := heap.Pop(sl)
-		NodesToPing = append(NodesToPing, tmpNode.(Contact))
-	}
-
-	for _, c := range NodesToPing {
-		heap.Push(sl, c)
+		if cand.State == candidateResponded {
+			contacts = append(contacts, cand.Contact)
+		}
 	}
-	return
+	return contacts
 }
 
-func (k *Kademlia) DoFindNodeWithChan(Chan_FindNode chan []Contact, contact Contact, searchKey ID) { // a wraper outside DoFindNode
-	// the original DoFindNode is returning a string.... have no choice but copy the code... :-(
-	peer := HostAndPortString(contact.Host, contact.Port) //create peer string for DialHTTP
-	client, err := rpc.DialHTTP("tcp", peer)              //creates client connection
-	if err != nil {
-		return
+// The closest candidate which answered without the value, and how many
+// candidates which have not failed are closer to Target than it.
+func (l *lookup) cacheTarget() (*Contact, int) {
+	holders := make(map[ID]bool)
+	for _, found := range l.Found {
+		holders[found.Contact.NodeID] = true
 	}
-	//create findvalue struct
-	request := new(FindNodeRequest)
-	var result FindNodeResult
-	request.Sender = k.SelfContact
-	request.MsgID = NewRandomID()
-	request.NodeID = searchKey
-	err = client.Call("KademliaCore.FindNode", request, &result)
-
-	if err != nil {
-		fmt.Printf("Error calling FindNode RPC")
+	closer := 0
+	for _, cand := range l.Candidates {
+		if cand.State == candidateFailed {
+			continue
+		}
+		if cand.State == candidateResponded && !holders[cand.Contact.NodeID] {
+			return &cand.Contact, closer
+		}
+		closer++
 	}
-	//fmt.Printf("func egegfe " + contact.NodeID.AsString() + "\n")
-
-	Chan_FindNode <- append(result.Nodes, contact)
+	return nil, 0
 }
 
-func (k *Kademlia) Contacts2String(Contacts []Contact) string {
-	output := fmt.Sprintf("successfully generated the shortlist of %v nodes\n", len(Contacts))
-	for _, c := range Contacts {
-		output = output + fmt.Sprintf("contact in shortlist: "+c.NodeID.AsString()+"\n")
+// How long a copy cached with closer nodes between it and its key lives:
+// expire halved once per node.
+func cacheTTL(expire time.Duration, closer int) time.Duration {
+	if closer > maxCacheHalvings {
+		closer = maxCacheHalvings
 	}
-
-	return output
+	return expire >> uint(closer)
 }
 
-func (k *Kademlia) DoIterativeFindNode(id ID) string {
-	// For project 2!
-	// to make my life easier, I wrote an *_internal function to generate the active list
-	// what I do here is to convert that list to a string
-	result := k.DoIterativeFindNode_Internal(id)
-	return k.Contacts2String(result)
+// Send one FIND_NODE or FIND_VALUE, bounded by lookupRPCTimeout.
+func (l *lookup) query(ctx context.Context, contact Contact) (reply lookupReply) {
+	ctx, cancel := context.WithTimeout(ctx, lookupRPCTimeout)
+	defer cancel()
+	reply.Contact = contact
+	if l.FindValue {
+		var result FindValueResult
+		result, reply.Err = l.kadem.findValue(ctx, &contact, l.Target)
+		reply.Value, reply.Nodes = result.Value, result.Nodes
+		reply.Publisher, reply.PublishedAt = result.Publisher, result.PublishedAt
+	} else {
+		reply.Nodes, reply.Err = l.kadem.DoFindNode(ctx, &contact, l.Target)
+	}
+	return
 }
 
-func (K *Kademlia) DoIterativeFindNode_Internal(id ID) []Contact {
-	// step 1: init shortlist, until we have alpha contacts
-	// the toping shortlist(the init alpha node to ping, and more to come)
-	ShortList_ToPing := K.InitAlphaNodes(id)
-	// the active shortlist(the list to return)
-	ShortList_Active := &ShortList{} // init active nodes
-	ShortList_Active.Id = id
-	ShortList_Active.LookUpTable = make(map[string]bool)
-	ShortList_Active.Locker = &sync.Mutex{}
-	heap.Init(ShortList_Active)
-	// look up table, to avoid
-	fmt.Printf("shorlist_toping len: %v, shortlist_active len: %v\n", ShortList_ToPing.Len(), ShortList_Active.Len())
-
-	UpdateClosest := true                 // if the closest node is updated
-	Chan_Timer := make(chan bool)         // timing the rpc
-	Chan_FindNode := make(chan []Contact) // returning the contacts found
-
-	// step 2: start the loop, set the max number of loops for safety
-	MaxNumLoops := 1000
-	for i := 0; (i < MaxNumLoops) && (UpdateClosest); i++ {
-		if ShortList_Active.Len() >= k {
-			fmt.Printf("We got enouth active nodes in the shortlist")
-			break
+// Run the lookup, following the Xlattice spec: keep up to alpha RPCs in
+// flight to the closest candidates, never ask anyone twice, and stop once the
+// k closest candidates which have not failed have all answered. It also
+// stops when Quorum values are found, returning the last of them, or when
+// ctx is done. No goroutine outlives run.
+func (l *lookup) run(ctx context.Context) *lookupReply {
+	ctx, cancel := context.WithCancel(ctx)
+	// buffered so that a worker can always deliver its reply, even once
+	// we have stopped listening
+	replies := make(chan lookupReply, alpha)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	inFlight := 0
+	for {
+		for inFlight < alpha {
+			cand := l.next()
+			if cand == nil {
+				break
+			}
+			cand.State = candidateQueried
+			inFlight++
+			wg.Add(1)
+			go func(contact Contact) {
+				defer wg.Done()
+				replies <- l.query(ctx, contact)
+			}(cand.Contact)
 		}
-		// step 2.1: select alpha uncontacted nodes from shortlist, and start alpha routine to ping them
-		NodesToPing, err := K.GetAlphaNodes(ShortList_ToPing)
-		if err != nil { // less than alpha nodes
-			fmt.Printf("%v nodes, Less than Alpha nodes to ping\n", len(NodesToPing))
-			break
+		if inFlight == 0 { // the k closest have all answered
+			return nil
 		}
-		// run alpha find node rpc at the same time
-		fmt.Printf("# of nodes to ping this iteration: %v\n", len(NodesToPing))
-		for idx, node := range NodesToPing { // for each node to ping
-			fmt.Printf("Pinging node #%v\n", idx)
-			fmt.Printf("Pinging node is: " + node.NodeID.AsString() + "\n")
-			//go func() {
-			go K.DoFindNodeWithChan(Chan_FindNode, node, id)
-			//ShortList_Active.Locker.Lock()
-			//heap.Push(ShortList_Active, node) // inserting the current node to active node, after we succeeded in pinging it
-			//ShortList_Active.Locker.Unlock()
-			//}()
 
+		var reply lookupReply
+		select {
+		case <-ctx.Done():
+			return nil
+		case reply = <-replies:
 		}
-		// run one timer
-		go func() {
-			time.Sleep(300 * time.Millisecond)
-			Chan_Timer <- true
-		}()
-
-		// step 2.2: call rpc FindNode and merge returned contacts(alpha * k) with our shortlists
-		TimeOut := false
-		var OldClosest Contact
-		if ShortList_ToPing.Len() > 0 {
-			OldClosest = (heap.Pop(ShortList_ToPing)).(Contact) // keep track of the old closest one
-			heap.Push(ShortList_ToPing, OldClosest)
+		inFlight--
+		cand := l.Seen[reply.Contact.NodeID]
+		if reply.Err != nil {
+			cand.State = candidateFailed
+			continue
 		}
-		for !TimeOut {
-			select {
-			case <-Chan_Timer: // timed out
-				TimeOut = true
-			case Nodes := <-Chan_FindNode: // received new nodes from rpc
-				for idx, node := range Nodes {
-					if idx+1 < len(Nodes) {
-						heap.Push(ShortList_ToPing, node)
-					} else {
-						heap.Push(ShortList_Active, node)
-					}
-				}
+		cand.State = candidateResponded
+		if reply.Value != nil {
+			l.Found = append(l.Found, reply)
+			if len(l.Found) >= l.Quorum {
+				return &reply
 			}
+			continue
 		}
-		// check if the closest is updated
-		if ShortList_ToPing.Len() > 0 {
-			NewClosest := (heap.Pop(ShortList_ToPing)).(Contact)
-			heap.Push(ShortList_ToPing, NewClosest)
-			UpdateClosest = (OldClosest.NodeID.Compare(NewClosest.NodeID) != 0)
-		} else {
-			UpdateClosest = true
+		for _, c := range reply.Nodes {
+			l.add(c)
 		}
-		fmt.Printf("shorlist_toping len: %v, shortlist_active len: %v\n", ShortList_ToPing.Len(), ShortList_Active.Len())
 	}
-
-	// step 3: return the active contacts in that shortlist
-	return ShortList_Active.Contacts
 }
-func (K *Kademlia) DoIterativeStore(key ID, value []byte) string {
+
+// Return the closest nodes to id that answered during an iterative lookup.
+func (k *Kademlia) DoIterativeFindNode(ctx context.Context, id ID) ([]Contact, error) {
 	// For project 2!
-	Contacts := K.DoIterativeFindNode_Internal(key)
-	output := fmt.Sprintf("")
-	for idx, contact := range Contacts {
-		if idx == 0 {
-			output = output + fmt.Sprintf("the node to store : "+contact.NodeID.AsString()+"\n")
-			output = output + K.DoStore(&contact, key, value)
-		} else {
-			break
-		}
+	result := k.DoIterativeFindNode_Internal(ctx, id)
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
 	}
-	return output
-}
-
-/*Structurally very similar to IterativeFindNode but uses the FIND_VALUE RPC
- *Additionally, it terminates the function if the value is found with the value
- *and the contact that found the value
- */
-func (K *Kademlia) DoIterativeFindValue(key ID) string {
-
-	val, contact := K.DoIterativeFindValue_Internal(key)
-
-	var output string
-
-	if val != nil {
-		output = fmt.Sprintf("ID: %v  Value: %v", contact[0].NodeID, val)
-	} else {
-		output = "ERR"
+	if len(result) == 0 {
+		return nil, &NotFoundError{id, "no node answered the lookup"}
 	}
-
-	return output
+	return result, nil
 }
 
-//structure for holding the result of FIND_VALUE RPC and Contact that it is being called with
-type iter_value struct {
-	value_result   FindValueResult
-	contact_called []Contact
-	self           Contact
+// Run an iterative lookup for id and return the k closest nodes which
+// answered, sorted by distance to id. It stops early when ctx is done,
+// returning what it has found so far.
+func (K *Kademlia) DoIterativeFindNode_Internal(ctx context.Context, id ID) []Contact {
+	l := K.newLookup(id, false)
+	l.run(ctx)
+	return l.responded(k)
 }
 
-//Structurally similar to DoIterativeFindNode_Internal
-func (K *Kademlia) DoIterativeFindValue_Internal(key ID) ([]byte, []Contact) {
-	var value []byte
-	value = nil
-
-	// step 1: init shortlist, until we have alpha contacts
-	// the toping shortlist(the init alpha node to ping, and more to come)
-	ShortList_ToPing := K.InitAlphaNodes(key)
-	// the active shortlist(the list to return)
-	ShortList_Active := &ShortList{} // init active nodes
-	ShortList_Active.Id = key
-	ShortList_Active.LookUpTable = make(map[string]bool)
-	heap.Init(ShortList_Active)
-	// look up table, to avoid
-	fmt.Printf("shorlist_toping len: %v, shortlist_active len: %v\n", ShortList_ToPing.Len(), ShortList_Active.Len())
-
-	UpdateClosest := true                      // if the closest node is updated
-	Chan_Timer := make(chan bool)              // timing the rpc
-	chan_value_result := make(chan iter_value) // returning the contacts found
-
-	// step 2: start the loop, set the max number of loops for safety
-	MaxNumLoops := 1000
-	for i := 0; (i < MaxNumLoops) && (UpdateClosest); i++ {
-		if ShortList_Active.Len() >= k {
-			fmt.Printf("We got enouth active nodes in the shortlist")
-			break
-		}
-		// step 2.1: select alpha uncontacted nodes from shortlist, and start alpha routine to ping them
-		NodesToPing, err := K.GetAlphaNodes(ShortList_ToPing)
-		if err != nil { // less than alpha nodes
-			fmt.Printf("%v nodes, Less than Alpha nodes to ping\n", len(NodesToPing))
-			break
-		}
-		// run alpha find node rpc at the same time
-		fmt.Printf("# of nodes to ping this iteration: %v\n", len(NodesToPing))
-		for idx, node := range NodesToPing { // for each node to ping
-			fmt.Printf("Pinging node #%v\n", idx)
-			fmt.Printf("Pinging node is: " + node.NodeID.AsString() + "\n")
-
-			go K.DoFindValueWithChan(chan_value_result, node, key)
-		}
-		// run one timer
-		go func() {
-			time.Sleep(300 * time.Millisecond)
-			Chan_Timer <- true
-		}()
+// The outcome of storing a value on one node.
+type StoreReport struct {
+	Contact Contact
+	Err     error // nil when the node acknowledged the store
+}
 
-		// step 2.2: call rpc FindNode and merge returned contacts(alpha * k) with our shortlists
-		TimeOut := false
-		var OldClosest Contact
-		if ShortList_ToPing.Len() > 0 {
-			OldClosest = (heap.Pop(ShortList_ToPing)).(Contact) // keep track of the old closest one
-			heap.Push(ShortList_ToPing, OldClosest)
+// Store the value on the k nodes closest to key, all at once, and report how
+// each of them did, closest first. It fails with ErrQuorum when fewer than
+// WriteQuorum nodes acknowledged, still returning the reports. A WriteQuorum
+// below 1 counts as 1.
+func (K *Kademlia) DoIterativeStore(ctx context.Context, key ID, value []byte) ([]StoreReport, error) {
+	// For project 2!
+	Contacts, err := K.DoIterativeFindNode(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	now := K.Clock.Now()
+	sv := StoredValue{Value: value, Publisher: K.NodeID, PublishedAt: now,
+		ExpiresAt: now.Add(K.ExpireInterval)}
+	reports := K.storeAll(ctx, Contacts, key, sv)
+	acks := 0
+	for _, report := range reports {
+		if report.Err == nil {
+			acks++
 		}
-		for !TimeOut {
-			select {
-			case <-Chan_Timer: // timed out
-				TimeOut = true
-			case Result := <-chan_value_result: // received new nodes from rpc
-				if Result.value_result.Value != nil {
-
-					//saves value and node that value is stored at
-					value = Result.value_result.Value
-					contact := Result.contact_called
-					//performs DoStore on closest node that doesn't have value
-					for _, node := range ShortList_Active.Contacts {
-						if node.NodeID.Compare(contact[0].NodeID) != 0 {
-							K.DoStore(&node, key, value)
-							break
-						}
-					}
-
-					//returns value and contact that has the value
-					return value, contact
-
-				} else {
+	}
+	quorum := K.WriteQuorum
+	if quorum < 1 { // storing nowhere is never a success
+		quorum = 1
+	}
+	if acks < quorum {
+		return reports, fmt.Errorf("%w: %v of %v replicas acknowledged", ErrQuorum, acks, quorum)
+	}
+	return reports, nil
+}
 
-					//continues with regular FindNode
-					for _, node := range Result.value_result.Nodes {
-						heap.Push(ShortList_ToPing, node)
-					}
-					heap.Push(ShortList_Active, Result.self)
+// Send sv to every contact concurrently, each store bounded by rpcTimeout.
+func (K *Kademlia) storeAll(ctx context.Context, contacts []Contact, key ID, sv StoredValue) []StoreReport {
+	reports := make([]StoreReport, len(contacts))
+	var wg sync.WaitGroup
+	for i := range contacts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storeCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+			defer cancel()
+			reports[i] = StoreReport{contacts[i], K.sendStore(storeCtx, &contacts[i], key, sv)}
+		}(i)
+	}
+	wg.Wait()
+	return reports
+}
 
-				}
-			}
-		}
-		// check if the closest is updated
-		if ShortList_ToPing.Len() > 0 {
-			NewClosest := (heap.Pop(ShortList_ToPing)).(Contact)
-			heap.Push(ShortList_ToPing, NewClosest)
-			UpdateClosest = (OldClosest.NodeID.Compare(NewClosest.NodeID) != 0)
-		} else {
-			UpdateClosest = true
+/*Structurally very similar to IterativeFindNode but uses the FIND_VALUE RPC
+ *Additionally, it terminates the function if the value is found with the value
+ *and the contact that found the value
+ */
+func (K *Kademlia) DoIterativeFindValue(ctx context.Context, key ID) ([]byte, *Contact, error) {
+	val, contact := K.DoIterativeFindValue_Internal(ctx, key)
+	if val == nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctxError(ctx)
 		}
+		return nil, nil, &NotFoundError{key, "value not found"}
 	}
-
-	// step 3: return the active contacts with a nil value (Could not find the value)
-	return value, ShortList_Active.Contacts
-
+	return val, &contact[0], nil
 }
 
-func (K *Kademlia) DoFindValueWithChan(f_value_result chan iter_value, contact Contact, key ID) {
-
-	peer := HostAndPortString(contact.Host, contact.Port)
-	client, err := rpc.DialHTTP("tcp", peer)
-	if err != nil {
-		log.Fatal("ERR: ", err)
+// Run an iterative FIND_VALUE for key. If a node holds the value, return it
+// and that node; otherwise return nil and the closest nodes which answered.
+func (K *Kademlia) DoIterativeFindValue_Internal(ctx context.Context, key ID) ([]byte, []Contact) {
+	l := K.newLookup(key, true)
+	found := l.run(ctx)
+	if found == nil {
+		return nil, l.responded(k)
 	}
 
-	request := new(FindValueRequest)
-	request.Sender = K.SelfContact
-	request.MsgID = NewRandomID()
-	request.Key = key
-
-	var result FindValueResult
-	err = client.Call("KademliaCore.FindValue", request, &result)
-	if err != nil {
-		log.Fatal("ERR: ", err)
+	// cache the value on the closest node which answered without it, for a
+	// time halved by each node between it and the key
+	if node, closer := l.cacheTarget(); node != nil {
+		sv := StoredValue{Value: found.Value, Publisher: found.Publisher, PublishedAt: found.PublishedAt,
+			ExpiresAt: K.Clock.Now().Add(cacheTTL(K.ExpireInterval, closer)), Cached: true}
+		storeCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+		K.sendStore(storeCtx, node, key, sv)
+		cancel()
 	}
-
-	v_called := make([]Contact, 1, 1)
-	v_called[0] = contact
-
-	f_value_result <- iter_value{result, v_called, contact}
-
+	return found.Value, []Contact{found.Contact}
 }
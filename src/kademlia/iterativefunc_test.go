@@ -0,0 +1,262 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIterativeFindNodeCancelled(t *testing.T) {
+	network, nodes := newTestNetwork(t, 10)
+	for _, node := range nodes[1:] {
+		network.SetDelay(HostAndPortString(node.SelfContact.Host, node.SelfContact.Port), time.Second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := nodes[0].DoIterativeFindNode(ctx, NewRandomID())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Was %v, but expected %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("lookup took %v after being cancelled", elapsed)
+	}
+}
+
+func TestIterativeFindNodeNoLeak(t *testing.T) {
+	network, nodes := newTestNetwork(t, 20)
+	// half the network is gone, a few more answer too slowly
+	for i, node := range nodes[1:] {
+		peer := HostAndPortString(node.SelfContact.Host, node.SelfContact.Port)
+		switch {
+		case i%2 == 0:
+			network.Remove(peer)
+		case i%5 == 1:
+			network.SetDelay(peer, 2*lookupRPCTimeout)
+		}
+	}
+
+	before := runtime.NumGoroutine()
+	l := nodes[0].newLookup(NewRandomID(), false)
+	l.run(context.Background())
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%v goroutines before the lookup, %v after", before, after)
+	}
+
+	for _, cand := range l.Candidates {
+		peer := HostAndPortString(cand.Contact.Host, cand.Contact.Port)
+		_, alive := network.Nodes[peer]
+		switch {
+		case cand.State == candidateResponded && !alive:
+			t.Errorf("%s responded but is gone", peer)
+		case cand.State == candidateFailed && alive && network.Delays[peer] == 0:
+			t.Errorf("%s failed but is alive", peer)
+		}
+	}
+}
+
+func TestIterativeFindValue(t *testing.T) {
+	_, nodes := newTestNetwork(t, 10)
+	key := NewRandomID()
+	if err := nodes[5].DoStore(context.Background(), &nodes[0].SelfContact, key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	value, holder, err := nodes[3].DoIterativeFindValue(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" {
+		t.Errorf("Was %q, but expected %q", value, "hello")
+	}
+	if holder.NodeID != nodes[0].NodeID {
+		t.Errorf("value came from %s, which never stored it", holder.NodeID.AsString())
+	}
+}
+
+func TestIterativeFindValueBeyondFirstHop(t *testing.T) {
+	_, nodes := newTestNetwork(t, 10)
+	key := NewRandomID()
+	// only reachable through nodes[0], which nodes[3] has to ask first
+	if err := nodes[0].DoStore(context.Background(), &nodes[5].SelfContact, key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	value, holder, err := nodes[3].DoIterativeFindValue(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" {
+		t.Errorf("Was %q, but expected %q", value, "hello")
+	}
+	if holder.NodeID != nodes[5].NodeID {
+		t.Errorf("value came from %s, which never stored it", holder.NodeID.AsString())
+	}
+}
+
+// Counts the FIND_NODE RPCs sent to each peer.
+type countingTransport struct {
+	Transport
+	Locker *sync.Mutex
+	Counts map[string]int
+}
+
+func (t *countingTransport) FindNode(ctx context.Context, peer string, req FindNodeRequest, res *FindNodeResult) error {
+	t.Locker.Lock()
+	t.Counts[peer]++
+	t.Locker.Unlock()
+	return t.Transport.FindNode(ctx, peer, req, res)
+}
+
+func TestIterativeFindNodeReturnsKClosest(t *testing.T) {
+	_, nodes := newTestNetwork(t, 2*k)
+	// let everyone know everyone
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				Update(a, &b.SelfContact)
+			}
+		}
+	}
+	waitForPings(t, nodes[0])
+	counter := &countingTransport{nodes[0].Transport, &sync.Mutex{}, make(map[string]int)}
+	nodes[0].Transport = counter
+
+	target := NewRandomID()
+	result, err := nodes[0].DoIterativeFindNode(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]Contact, 0, len(nodes)-1)
+	for _, node := range nodes[1:] {
+		want = append(want, node.SelfContact)
+	}
+	sortByDistance(want, target)
+	want = want[:k]
+	if len(result) != k {
+		t.Fatalf("Was %v contacts, but expected %v", len(result), k)
+	}
+	for i := range want {
+		if result[i].NodeID != want[i].NodeID {
+			t.Errorf("contact #%v was %s, but expected %s", i, result[i].NodeID.AsString(), want[i].NodeID.AsString())
+		}
+	}
+	for peer, count := range counter.Counts {
+		if count > 1 {
+			t.Errorf("%s was queried %v times", peer, count)
+		}
+	}
+}
+
+func TestLatencyAwareNext(t *testing.T) {
+	network := NewMemNetwork()
+	node, _ := network.NewKademlia("127.0.0.1:0")
+	node.LatencyAware = true
+	target := NewRandomID()
+	l := &lookup{kadem: node, Target: target, Seen: make(map[ID]*lookupCandidate)}
+
+	// one candidate much closer than three equally far ones
+	closest := Contact{RandomIDInBucket(target, 150), nil, 1}
+	unmeasured := Contact{RandomIDInBucket(target, b-1), nil, 2}
+	slow := Contact{RandomIDInBucket(target, b-1), nil, 3}
+	fast := Contact{RandomIDInBucket(target, b-1), nil, 4}
+	for _, c := range []Contact{closest, unmeasured, slow, fast} {
+		l.add(c)
+	}
+	l.Seen[slow.NodeID].RTT = 100 * time.Millisecond
+	l.Seen[fast.NodeID].RTT = 10 * time.Millisecond
+
+	for _, want := range []Contact{closest, fast, slow, unmeasured} {
+		cand := l.next()
+		if cand == nil || cand.Contact.NodeID != want.NodeID {
+			t.Fatalf("Was %v, but expected port %v", cand, want.Port)
+		}
+		cand.State = candidateResponded
+	}
+	if cand := l.next(); cand != nil {
+		t.Errorf("Was %v, but expected nil", cand)
+	}
+}
+
+// Refuses the STOREs sent to some peers.
+type refusingTransport struct {
+	Transport
+	Refuse map[string]bool
+}
+
+func (t *refusingTransport) Store(ctx context.Context, peer string, req StoreRequest, res *StoreResult) error {
+	if t.Refuse[peer] {
+		return newRPCError("Store", peer, ErrRemote, errors.New("refused"))
+	}
+	return t.Transport.Store(ctx, peer, req, res)
+}
+
+func TestIterativeStoreQuorum(t *testing.T) {
+	_, nodes := newTestNetwork(t, 6)
+	waitForPings(t, nodes[0])
+	refusing := &refusingTransport{nodes[0].Transport, make(map[string]bool)}
+	for _, node := range nodes[1:3] {
+		refusing.Refuse[HostAndPortString(node.SelfContact.Host, node.SelfContact.Port)] = true
+	}
+	nodes[0].Transport = refusing
+	nodes[0].WriteQuorum = 3
+
+	key := NewRandomID()
+	reports, err := nodes[0].DoIterativeStore(context.Background(), key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 5 {
+		t.Fatalf("Was %v reports, but expected %v", len(reports), 5)
+	}
+	for _, report := range reports {
+		peer := HostAndPortString(report.Contact.Host, report.Contact.Port)
+		if (report.Err != nil) != refusing.Refuse[peer] {
+			t.Errorf("%s reported %v", peer, report.Err)
+		}
+	}
+	for _, node := range nodes[3:] {
+		if v, err := node.LocalFindValue(key); string(v) != "hello" {
+			t.Errorf("%s did not get the value: %v", node.NodeID.AsString(), err)
+		}
+	}
+
+	nodes[0].WriteQuorum = 4
+	if _, err := nodes[0].DoIterativeStore(context.Background(), key, []byte("hello")); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Was %v, but expected %v", err, ErrQuorum)
+	}
+
+	// no quorum at all still needs one replica
+	for _, node := range nodes[3:] {
+		refusing.Refuse[HostAndPortString(node.SelfContact.Host, node.SelfContact.Port)] = true
+	}
+	nodes[0].WriteQuorum = 0
+	if _, err := nodes[0].DoIterativeStore(context.Background(), key, []byte("hello")); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Was %v, but expected %v", err, ErrQuorum)
+	}
+}
+
+func TestIterativeLookupDeadline(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	b, _ := network.NewKademlia("127.0.0.1:0")
+	Update(a, &b.SelfContact)
+	network.SetDelay(HostAndPortString(b.SelfContact.Host, b.SelfContact.Port), time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.DoIterativeFindNode(ctx, NewRandomID()); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Was %v, but expected %v", err, ErrTimeout)
+	}
+	if _, _, err := a.DoIterativeFindValue(ctx, NewRandomID()); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Was %v, but expected %v", err, ErrTimeout)
+	}
+}
@@ -4,52 +4,124 @@ package kademlia
 // as a receiver for the RPC methods, which is required by that package.
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
 const (
 	alpha = 3
 	b     = 8 * IDBytes
 	k     = 20
+
+	// deadline for a single RPC the node sends on its own behalf
+	rpcTimeout = 3 * time.Second
 )
 
 // Kademlia type. You can put whatever state you need in this.
+//
+// Locking model. RPC handlers, lookups, evictions and maintenance all run in
+// their own goroutines, so:
+//   - each KBucket's fields are guarded by its Locker. Nobody holds two bucket
+//     locks at once, or makes an RPC while holding one;
+//   - Values is safe for concurrent use by itself, and Values_Lock makes our
+//     read-modify-write sequences on it atomic;
+//   - VDOS is guarded by VDOS_Lock;
+//   - every other field is unguarded: it may only be written while nothing
+//     else uses the node. Config sets the tuning while the node is created;
+//     tests also swap Transport, Clock or a quorum between operations, once
+//     the node's background work has settled;
+//   - a lookup belongs to the goroutine running it.
 type Kademlia struct {
 	NodeID      ID
 	SelfContact Contact
 	Buckets     []KBucket
-	Values      map[ID][]byte
+	Values      ValueStore
+	Values_Lock *sync.Mutex
 	VDOS_Lock   *sync.Mutex
 	VDOS        map[ID]VanashingDataObject
+	Transport   Transport // used for every outgoing RPC
+	listener    net.Listener
+
+	Clock           Clock         // source of time for all maintenance
+	RefreshInterval time.Duration // a bucket idle this long gets refreshed
+	// every value we hold is republished this often, and dropped once this
+	// long has passed since its original publication
+	RepublishInterval time.Duration
+	ExpireInterval    time.Duration
+	MaxFailures       int      // evict a contact after this many failed RPCs in a row
+	LatencyAware      bool     // lookups prefer faster contacts among equally close ones
+	WriteQuorum       int      // how many replicas DoIterativeStore needs to succeed
+	ReadQuorum        int      // how many holders DoQuorumFindValue asks
+	Resolver          Resolver // how DoQuorumFindValue settles disagreements
+	stopMaintenance   context.CancelFunc
+	maintenanceDone   chan struct{} // closed once maintain has returned
+
+	DataDir       string    // see persist.go; empty when nothing persists
+	savedContacts []Contact // the routing table a previous run left us
 }
 
-func NewKademlia(laddr string) *Kademlia {
-	// TODO: Initialize other state here as you add functionality.
-	k := new(Kademlia)
-	k.NodeID = NewRandomID()
+// Optional settings for NewKademliaWithConfig. Zero fields take defaults.
+type Config struct {
+	// Where stored values live. By default they are logged in DataDir, or
+	// kept in memory if there is none.
+	Values ValueStore
+	// Keep our ID, routing table and values here across restarts.
+	DataDir string
+	// The tuning of lookups and replication; see the Kademlia fields of the
+	// same names. Zero quorums are 1, and the Resolver is a MajorityResolver.
+	LatencyAware bool
+	WriteQuorum  int
+	ReadQuorum   int
+	Resolver     Resolver
+}
+
+// Create a node listening on laddr. Each node gets its own mux and listener,
+// and each connection its own rpc.Server, so any number of nodes can live in
+// one process.
+func NewKademlia(laddr string) (*Kademlia, error) {
+	return NewKademliaWithConfig(laddr, Config{})
+}
+
+func NewKademliaWithConfig(laddr string, cfg Config) (*Kademlia, error) {
+	k, err := newKademlia(NewHTTPTransport(), cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set up RPC server
 	// NOTE: KademliaCore is just a wrapper around Kademlia. This type includes
-	// the RPC functions.
-	rpc.Register(&KademliaCore{k})
-	rpc.HandleHTTP()
+	// the RPC functions. rpcHandler gives each connection its own.
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, &rpcHandler{k})
 	l, err := net.Listen("tcp", laddr)
 	if err != nil {
-		log.Fatal("Listen: ", err)
+		k.Values.Close()
+		return nil, err
 	}
-	// Run RPC server forever.
-	go http.Serve(l, nil)
 
 	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
+	hostname, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		l.Close()
+		k.Values.Close()
+		return nil, err
+	}
 	port_int, _ := strconv.Atoi(port)
 	ipAddrStrings, err := net.LookupHost(hostname)
+	if err != nil {
+		l.Close()
+		k.Values.Close()
+		return nil, err
+	}
 	var host net.IP
 	for i := 0; i < len(ipAddrStrings); i++ {
 		host = net.ParseIP(ipAddrStrings[i])
@@ -58,39 +130,118 @@ func NewKademlia(laddr string) *Kademlia {
 		}
 	}
 	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
-	fmt.Printf("Self Id: " + k.NodeID.AsString() + "\n")
+	k.listener = l
+	// Run RPC server until Close.
+	go http.Serve(l, mux)
+	k.startMaintenance()
+	return k, nil
+}
+
+// Stop accepting RPCs, end the background maintenance, save the routing
+// table and close the value store.
+func (k *Kademlia) Close() error {
+	k.stopMaintenance()
+	<-k.maintenanceDone // a tick may still be using the store
+	if k.listener != nil {
+		k.listener.Close()
+	}
+	err := k.SaveRoutingTable()
+	if cerr := k.Values.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Initialize the state every node needs, whichever transport it talks over.
+// The caller still has to fill in SelfContact.
+func newKademlia(transport Transport, cfg Config) (*Kademlia, error) {
+	// TODO: Initialize other state here as you add functionality.
+	if cfg.WriteQuorum < 0 || cfg.ReadQuorum < 0 {
+		return nil, errors.New("quorums must be at least 1")
+	}
+	k := new(Kademlia)
+	k.NodeID = NewRandomID()
+	k.DataDir = cfg.DataDir
+	if k.DataDir != "" {
+		if err := os.MkdirAll(k.DataDir, 0700); err != nil {
+			return nil, err
+		}
+		id, err := loadNodeID(k.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		k.NodeID = id
+		if k.savedContacts, err = loadContacts(k.DataDir); err != nil {
+			return nil, err
+		}
+	}
+	k.Transport = transport
+	k.Clock = systemClock{}
+	k.RefreshInterval = time.Hour
+	k.RepublishInterval = time.Hour
+	k.ExpireInterval = 24 * time.Hour
+	k.MaxFailures = 3
+	k.LatencyAware = cfg.LatencyAware
+	k.WriteQuorum = cfg.WriteQuorum
+	if k.WriteQuorum == 0 {
+		k.WriteQuorum = 1
+	}
+	k.ReadQuorum = cfg.ReadQuorum
+	if k.ReadQuorum == 0 {
+		k.ReadQuorum = 1
+	}
+	k.Resolver = cfg.Resolver
+	if k.Resolver == nil {
+		k.Resolver = MajorityResolver{}
+	}
 	// init Buckets
 	k.Buckets = make([]KBucket, b)
 	for i, _ := range k.Buckets {
 		k.Buckets[i] = *(NewKBucket())
+		k.Buckets[i].LastLookup = k.Clock.Now()
+	}
+	k.Values = cfg.Values
+	if k.Values == nil && k.DataDir != "" {
+		values, err := NewFileValueStore(filepath.Join(k.DataDir, valuesFile))
+		if err != nil {
+			return nil, err
+		}
+		k.Values = values
 	}
-	k.Values = make(map[ID][]byte)
+	if k.Values == nil {
+		k.Values = NewMemValueStore()
+	}
+	k.Values_Lock = &sync.Mutex{}
 	k.VDOS_Lock = &sync.Mutex{}
 	k.VDOS = make(map[ID]VanashingDataObject)
-	return k
+	return k, nil
 }
 
 func Update(k *Kademlia, contact *Contact) { // update the kbucket with contact
+	if contact.NodeID == k.NodeID { // we never store ourselves
+		return
+	}
 	dist := k.NodeID.Xor(contact.NodeID)
 	idx := GetBucketIndex(dist)
 	bucket := &k.Buckets[idx]
 	bucket.Locker.Lock()
-	bucket.Update(contact)
+	bucket.Update(k, contact)
 	bucket.Locker.Unlock()
 }
 
+// Return the index of the bucket covering distance. Bucket i holds the
+// contacts whose distance from us is in [2^i, 2^(i+1)), with the most
+// significant bit in byte 0 as for Compare; the farthest half of the ID space
+// is bucket b-1. A zero distance maps to bucket 0.
 func GetBucketIndex(distance ID) int {
-	//return the leftmost bit 1: 0011 0101 -> 3
-	index := 0
-	for i := IDBytes - 1; i >= 0; i-- {
+	for i := 0; i < IDBytes; i++ {
 		for j := 7; j >= 0; j-- {
 			if (distance[i]>>uint8(j))&0x1 != 0 {
-				index = b - (8*i + j)
-				return index
+				return b - 1 - (8*i + 7 - j)
 			}
 		}
 	}
-	return index
+	return 0
 }
 
 type NotFoundError struct {
@@ -102,6 +253,10 @@ func (e *NotFoundError) Error() string {
 	return fmt.Sprintf("%x %s", e.id, e.msg)
 }
 
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
 func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	// Find contact with provided ID
 	if nodeId == k.SelfContact.NodeID { // basic case: nodeId = self
@@ -109,9 +264,11 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	}
 	distance := k.NodeID.Xor(nodeId)
 	index := GetBucketIndex(distance)
-	for _, contact := range k.Buckets[index].Contacts {
+	bucket := &k.Buckets[index]
+	bucket.Locker.Lock()
+	defer bucket.Locker.Unlock()
+	for _, contact := range bucket.Contacts {
 		if contact.NodeID == nodeId {
-			fmt.Printf("Find Contact:" + contact.NodeID.AsString() + "\n")
 			return &contact, nil
 		}
 	}
@@ -127,66 +284,81 @@ func HostAndPortString(host net.IP, port uint16) (peer string) {
 	return peer
 }
 
-// This is the function to perform the RPC
-func (k *Kademlia) DoPing(host net.IP, port uint16) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	peer := HostAndPortString(host, port)    //create peer string for DialHTTP
-	client, err := rpc.DialHTTP("tcp", peer) //creates client connection
+// Resolve a "host:port" string, preferring an IPv4 address for host.
+func ParseHostAndPort(addr string) (host net.IP, port uint16, err error) {
+	hostname, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port_int, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return
+	}
+	ipAddrStrings, err := net.LookupHost(hostname)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return
+	}
+	for i := 0; i < len(ipAddrStrings); i++ {
+		host = net.ParseIP(ipAddrStrings[i])
+		if host.To4() != nil {
+			break
+		}
 	}
+	return host, uint16(port_int), nil
+}
 
-	defer client.Close() //close client when finished with ping and pong
+// Ping the node at host:port and return the contact it answered with.
+func (k *Kademlia) DoPing(ctx context.Context, host net.IP, port uint16) (Contact, error) {
+	peer := HostAndPortString(host, port) //create peer string for the transport
 	//create ping
 	ping := new(PingMessage)
 	ping.Sender = k.SelfContact //create sender
 	ping.MsgID = NewRandomID()  //create messageID
 	//create pong
 	var pong PongMessage //create pong that holds value from server
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	} else {
-		Update(k, &pong.Sender)
+	start := time.Now()
+	if err := k.Transport.Ping(ctx, peer, *ping, &pong); err != nil {
+		if contact, ok := k.contactAt(peer); ok {
+			k.recordRPC(contact, start, err)
+		}
+		return Contact{}, err
 	}
-	//output := fmt.Sprintf("OK: %v\n", pong) // by Haomin, debugging
-	output := fmt.Sprintf("ok! " + pong.Sender.NodeID.AsString())
-	return output
+	k.recordRPC(pong.Sender, start, nil)
+	return pong.Sender, nil
 }
 
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+// Store a new value on contact, published by us now.
+func (k *Kademlia) DoStore(ctx context.Context, contact *Contact, key ID, value []byte) error {
+	now := k.Clock.Now()
+	sv := StoredValue{Value: value, Publisher: k.NodeID, PublishedAt: now,
+		ExpiresAt: now.Add(k.ExpireInterval)}
+	return k.sendStore(ctx, contact, key, sv)
+}
+
+func (k *Kademlia) sendStore(ctx context.Context, contact *Contact, key ID, sv StoredValue) error {
 	request := new(StoreRequest)                          //create store request request struc
 	var result StoreResult                                //create storeresult struc to hold return value
-	peer := HostAndPortString(contact.Host, contact.Port) //create peer string for DialHTTP
-	client, err := rpc.DialHTTP("tcp", peer)              //creates client connection
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	}
-	//do we need hash function here???
+	peer := HostAndPortString(contact.Host, contact.Port) //create peer string for the transport
 	//create request
-	request.Sender = *(contact)
+	request.Sender = k.SelfContact
 	request.MsgID = NewRandomID()
 	request.Key = key
-	request.Value = value
-	//rpc
-	err = client.Call("KademliaCore.Store", request, &result)
-	if err != nil {
-		log.Fatal("ERR: ", err)
+	request.Value = sv.Value
+	request.Publisher = sv.Publisher
+	request.PublishedAt = sv.PublishedAt
+	if sv.Cached {
+		request.CacheUntil = sv.ExpiresAt
 	}
-	//output := fmt.Sprintf("OK: %v\n", result)
-	output := fmt.Sprintf("ok!")
-	return output
+	//rpc
+	start := time.Now()
+	err := k.Transport.Store(ctx, peer, *request, &result)
+	k.recordRPC(*contact, start, err)
+	return err
 }
 
-func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	peer := HostAndPortString(contact.Host, contact.Port) //create peer string for DialHTTP
-	client, err := rpc.DialHTTP("tcp", peer)              //creates client connection
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	}
-	//again, do we need a hash function here?
+// Ask contact for the nodes it knows closest to searchKey.
+func (k *Kademlia) DoFindNode(ctx context.Context, contact *Contact, searchKey ID) ([]Contact, error) {
+	peer := HostAndPortString(contact.Host, contact.Port) //create peer string for the transport
 	//create findvalue struct
 	request := new(FindNodeRequest)
 	var result FindNodeResult
@@ -194,80 +366,81 @@ func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
 	request.MsgID = NewRandomID()
 	request.NodeID = searchKey
 	//make call
-	err = client.Call("KademliaCore.FindNode", request, &result)
+	start := time.Now()
+	err := k.Transport.FindNode(ctx, peer, *request, &result)
+	k.recordRPC(*contact, start, err)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, err
 	}
-	//output := fmt.Sprintf("OK: %v\n", result.Nodes) //how can I return an array after "OK: "?!
-	fmt.Printf("debugging at find_node\n")
-	output := fmt.Sprintf("OK: " + result.Nodes[0].NodeID.AsString() + "\n") // by Haomin, dubugging
-	return output
+	return result.Nodes, nil
 }
 
-func (k *Kademlia) DoVanish(VdoID ID, data []byte, numberKeys byte, threshold byte) string {
-	vdo := VanishData(*k, data, numberKeys, threshold)
+// Vanish data, keeping the VDO under VdoID for whoever asks for it.
+func (k *Kademlia) DoVanish(ctx context.Context, VdoID ID, data []byte, numberKeys byte, threshold byte) error {
+	vdo, err := VanishData(ctx, k, data, numberKeys, threshold)
+	if err != nil {
+		return err
+	}
 	k.VDOS_Lock.Lock()
 	k.VDOS[VdoID] = vdo
 	k.VDOS_Lock.Unlock()
-	return "vanish is done"
+	return nil
 }
 
-func (k *Kademlia) DoUnvanish(contact *Contact, VdoID ID) string {
+// Fetch the VDO stored under VdoID on contact and recover its data.
+func (k *Kademlia) DoUnvanish(ctx context.Context, contact *Contact, VdoID ID) ([]byte, error) {
 	peer := HostAndPortString(contact.Host, contact.Port)
-	client, err := rpc.DialHTTP("tcp", peer)
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	}
 	//make findvaluerequest struct
 	request := new(GetVDORequest)
 	request.Sender = k.SelfContact
 	request.MsgID = NewRandomID()
 	request.VdoID = VdoID
 	var result GetVDOResult
-	err = client.Call("KademliaCore.GetVDO", request, &result)
+	start := time.Now()
+	err := k.Transport.GetVDO(ctx, peer, *request, &result)
+	k.recordRPC(*contact, start, err)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, err
+	}
+	if result.VDO.Ciphertext == nil {
+		return nil, &NotFoundError{VdoID, "VDO not found"}
 	}
-	data := UnvanishData(*k, result.VDO)
-	//data := UnvanishData(*k, k.VDOS[VdoID])
-	output := fmt.Sprintf("OK: the length of data is %v\n", len(data))
-	return output
+	return UnvanishData(ctx, k, result.VDO)
 }
 
-func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	peer := HostAndPortString(contact.Host, contact.Port)
-	client, err := rpc.DialHTTP("tcp", peer)
+// Ask contact for the value stored under searchKey. If it does not hold the
+// value, value is nil and nodes are the closest contacts it knows instead.
+func (k *Kademlia) DoFindValue(ctx context.Context, contact *Contact, searchKey ID) (value []byte, nodes []Contact, err error) {
+	result, err := k.findValue(ctx, contact, searchKey)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, nil, err
 	}
+	return result.Value, result.Nodes, nil
+}
+
+// DoFindValue, returning the whole result with the value's publication.
+func (k *Kademlia) findValue(ctx context.Context, contact *Contact, searchKey ID) (FindValueResult, error) {
+	peer := HostAndPortString(contact.Host, contact.Port)
 	//make findvaluerequest struct
-	//do we need to hash?
 	request := new(FindValueRequest)
 	request.Sender = k.SelfContact
 	request.MsgID = NewRandomID()
 	request.Key = searchKey
 	//make call
 	var result FindValueResult
-	err = client.Call("KademliaCore.FindValue", request, &result)
-	if err != nil {
-		log.Fatal("ERR: ", err)
-		//should this be in "Err: <message>" format?
-	}
-	//output := fmt.Sprintf("Ok: %v\n", result) //still confused about the exact format we should output
-	fmt.Printf("debugging at find_value\n")
-	output := fmt.Sprintf("OK: " + result.Nodes[0].NodeID.AsString() + "\n")
-	return output
+	start := time.Now()
+	err := k.Transport.FindValue(ctx, peer, *request, &result)
+	k.recordRPC(*contact, start, err)
+	return result, err
 }
 
-func (k *Kademlia) LocalFindValue(searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	Val := k.Values[searchKey]
-	var output string
-	if Val == nil {
-		output = fmt.Sprintf("Err: Cannot find this value!")
-	} else {
-		output = fmt.Sprintf("Ok: %v\n", Val) //still confused about the exact format we should output
-	}
-	return output
+func (k *Kademlia) LocalFindValue(searchKey ID) ([]byte, error) {
+	sv, ok, err := k.findLocal(searchKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &NotFoundError{searchKey, "value not found"}
+	}
+	return sv.Value, nil
 }
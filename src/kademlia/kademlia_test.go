@@ -0,0 +1,213 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManyNodesInOneProcess(t *testing.T) {
+	nodes := make([]*Kademlia, 5)
+	for i := range nodes {
+		node, err := NewKademlia("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		nodes[i] = node
+	}
+
+	for _, node := range nodes[1:] {
+		if _, err := node.DoPing(context.Background(), nodes[0].SelfContact.Host, nodes[0].SelfContact.Port); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nodes[0].FindContact(node.NodeID); err != nil {
+			t.Errorf("first node did not learn %s: %v", node.NodeID.AsString(), err)
+		}
+	}
+}
+
+func TestNewKademliaBadAddress(t *testing.T) {
+	node, err := NewKademlia("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	if _, err := NewKademlia(HostAndPortString(node.SelfContact.Host, node.SelfContact.Port)); err == nil {
+		t.Error("Shouldn't have been able to listen on a used address")
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	node, err := NewKademlia("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Close()
+
+	// nobody listens on the closed node's port any more
+	if _, err := node.DoPing(context.Background(), node.SelfContact.Host, node.SelfContact.Port); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Was %v, but expected %v", err, ErrUnreachable)
+	}
+	if _, err := node.LocalFindValue(NewRandomID()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Was %v, but expected %v", err, ErrNotFound)
+	}
+	if _, err := node.FindContact(NewRandomID()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Was %v, but expected %v", err, ErrNotFound)
+	}
+}
+
+func TestHTTPHandshakeCancelled(t *testing.T) {
+	// accepts connections, but never answers the CONNECT
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	var pong PongMessage
+	err = NewHTTPTransport().Ping(ctx, l.Addr().String(), PingMessage{}, &pong)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Was %v, but expected %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ping took %v, the cancellation was not honoured", elapsed)
+	}
+}
+
+func TestGetBucketIndex(t *testing.T) {
+	var distance ID
+	if idx := GetBucketIndex(distance); idx != 0 {
+		t.Errorf("Was %v, but expected %v", idx, 0)
+	}
+	distance[IDBytes-1] = 0x01 // distance 1
+	if idx := GetBucketIndex(distance); idx != 0 {
+		t.Errorf("Was %v, but expected %v", idx, 0)
+	}
+	distance[IDBytes-1] = 0x05 // distance in [4, 8)
+	if idx := GetBucketIndex(distance); idx != 2 {
+		t.Errorf("Was %v, but expected %v", idx, 2)
+	}
+	distance[0] = 0x80 // the farthest half
+	if idx := GetBucketIndex(distance); idx != b-1 {
+		t.Errorf("Was %v, but expected %v", idx, b-1)
+	}
+}
+
+func TestForgedSenderOverHTTP(t *testing.T) {
+	node, err := NewKademlia("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	forged := Contact{NewRandomID(), net.IPv4(10, 0, 0, 1), 7890}
+	var pong PongMessage
+	err = node.Transport.Ping(context.Background(), HostAndPortString(node.SelfContact.Host, node.SelfContact.Port),
+		PingMessage{forged, NewRandomID()}, &pong)
+	if err != nil {
+		t.Fatalf("the ping was not answered: %v", err)
+	}
+	if pong.Sender.NodeID != node.NodeID {
+		t.Errorf("Was %s, but expected %s", pong.Sender.NodeID.AsString(), node.NodeID.AsString())
+	}
+	if _, err := node.FindContact(forged.NodeID); err == nil {
+		t.Error("learned a forged contact")
+	}
+}
+
+// Meant for go test -race: every kind of RPC and background work at once.
+func TestConcurrentRPCs(t *testing.T) {
+	network, nodes := newTestNetwork(t, 12)
+	keys := make([]ID, 8)
+	for i := range keys {
+		keys[i] = NewRandomID()
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Kademlia) {
+			defer wg.Done()
+			other := nodes[(i+1)%len(nodes)]
+			for j := 0; j < 20; j++ {
+				key := keys[(i+j)%len(keys)]
+				switch j % 6 {
+				case 0:
+					node.DoIterativeStore(ctx, key, []byte("hello"))
+				case 1:
+					node.DoIterativeFindValue(ctx, key)
+				case 2:
+					node.DoPing(ctx, other.SelfContact.Host, other.SelfContact.Port)
+					node.DoStore(ctx, &other.SelfContact, key, []byte("hi"))
+				case 3:
+					node.DoIterativeFindNode(ctx, key)
+					node.FindContact(other.NodeID)
+				case 4:
+					node.RefreshIdleBuckets(ctx)
+					node.ExpireValues()
+					node.RepublishValues(ctx)
+				case 5:
+					node.ContactStats()
+					node.SaveRoutingTable()
+					node.LocalFindValue(key)
+				}
+			}
+		}(i, node)
+	}
+	// nodes come and go meanwhile
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			node, err := network.NewKademlia("127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			node.Bootstrap(ctx, HostAndPortString(nodes[0].SelfContact.Host, nodes[0].SelfContact.Port))
+			network.Remove(HostAndPortString(node.SelfContact.Host, node.SelfContact.Port))
+		}
+	}()
+	wg.Wait()
+
+	for _, key := range keys {
+		if _, _, err := nodes[0].DoIterativeFindValue(ctx, key); err != nil {
+			t.Errorf("%s was lost: %v", key.AsString(), err)
+		}
+	}
+}
+
+func TestConfigTuning(t *testing.T) {
+	network := NewMemNetwork()
+	node, err := network.NewKademliaWithConfig("127.0.0.1:0", Config{LatencyAware: true, ReadQuorum: 3, Resolver: NewestResolver{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.LatencyAware || node.WriteQuorum != 1 || node.ReadQuorum != 3 {
+		t.Errorf("Was %v, %v, %v, but expected true, 1, 3", node.LatencyAware, node.WriteQuorum, node.ReadQuorum)
+	}
+	if _, ok := node.Resolver.(NewestResolver); !ok {
+		t.Errorf("Was %T, but expected NewestResolver", node.Resolver)
+	}
+	if _, err := network.NewKademliaWithConfig("127.0.0.1:0", Config{WriteQuorum: -1}); err == nil {
+		t.Error("a negative write quorum was accepted")
+	}
+}
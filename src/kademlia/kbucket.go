@@ -1,25 +1,35 @@
 package kademlia
 
 import (
-	"fmt"
-	"net/rpc"
-	"strconv"
+	"context"
 	"sync"
+	"time"
 )
 
 type KBucket struct {
-	Contacts []Contact
-	Locker   *sync.Mutex
+	Contacts   []Contact
+	Locker     *sync.Mutex
+	LastLookup time.Time // when a lookup last targeted this bucket's range
+
+	// Newcomers that did not fit in a full bucket, freshest last. One of them
+	// takes the place of a contact that stops answering.
+	Replacements []Contact
+	pinging      bool // whether a liveness check of Contacts[0] is running
+
+	Stats map[ID]*ContactStats // see stats.go
 }
 
 func NewKBucket() *KBucket {
 	result := new(KBucket)
 	result.Contacts = make([]Contact, 0, k) // k from in kademlia.go
+	result.Replacements = make([]Contact, 0, k)
+	result.Stats = make(map[ID]*ContactStats)
 	result.Locker = &sync.Mutex{}
 	return result
 }
 
-func (kb *KBucket) Update(contact *Contact) {
+// Must be called with Locker held.
+func (kb *KBucket) Update(kadem *Kademlia, contact *Contact) {
 	Index := -1
 	FlagExist := false
 	FlagFull := false
@@ -33,7 +43,7 @@ func (kb *KBucket) Update(contact *Contact) {
 
 	// exist?
 	for Idx, CurrCont := range kb.Contacts {
-		if CurrCont.NodeID.AsString() == contact.NodeID.AsString() {
+		if CurrCont.NodeID == contact.NodeID {
 			FlagExist = true
 			Index = Idx
 			break
@@ -41,29 +51,93 @@ func (kb *KBucket) Update(contact *Contact) {
 	}
 
 	if FlagExist { // case1: already exist
-		fmt.Printf("Updating Contact: " + contact.NodeID.AsString() + "\n")
 		if len(kb.Contacts) > 1 {
 			kb.Move2End(Index)
 		}
+		kb.seen(kadem, contact.NodeID)
 
 	} else if !FlagFull { // case2: not exist, not full
-		fmt.Printf("Appending Contact: " + contact.NodeID.AsString() + "\n")
 		kb.Contacts = append(kb.Contacts, *contact)
+		kb.seen(kadem, contact.NodeID)
 	} else { // case3: not exist but full
-		fmt.Printf("Choosing between Concact: " + contact.NodeID.AsString() + ", and Concact: " + kb.Contacts[0].NodeID.AsString() + "\n")
-		remoteStr := kb.Contacts[0].Host.String()
-		remoteStr = remoteStr + ":" + strconv.FormatUint(uint64(kb.Contacts[0].Port), 10)
-		remote, err := rpc.DialHTTP("tcp", remoteStr)
-		if err != nil { // case3.1 fail to contact the first one
-			kb.Contacts = append(kb.Contacts[1:], *contact)
-		} else { // case3.2 successfully contacted the first one
-			kb.Contacts = append(kb.Contacts[1:], kb.Contacts[0])
+		kb.addReplacement(*contact)
+		if !kb.pinging {
+			kb.pinging = true
+			go kb.checkOldest(kadem, kb.Contacts[0])
 		}
-		remote.Close()
 	}
 	return
 }
 
+// Remember contact as the freshest replacement, forgetting the stalest one
+// when the cache is full.
+func (kb *KBucket) addReplacement(contact Contact) {
+	for i, c := range kb.Replacements {
+		if c.NodeID == contact.NodeID {
+			kb.Replacements = append(kb.Replacements[:i], kb.Replacements[i+1:]...)
+			break
+		}
+	}
+	if len(kb.Replacements) == cap(kb.Replacements) {
+		kb.Replacements = append(kb.Replacements[:0], kb.Replacements[1:]...)
+	}
+	kb.Replacements = append(kb.Replacements, contact)
+}
+
+// Ping oldest without holding the lock. If it answers it becomes the most
+// recently seen contact; otherwise the freshest replacement takes its place.
+func (kb *KBucket) checkOldest(kadem *Kademlia, oldest Contact) {
+	var pong PongMessage
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	err := kadem.Transport.Ping(ctx, HostAndPortString(oldest.Host, oldest.Port),
+		PingMessage{kadem.SelfContact, NewRandomID()}, &pong)
+	cancel()
+
+	kb.Locker.Lock()
+	defer kb.Locker.Unlock()
+	kb.pinging = false
+	Index := -1
+	for Idx, CurrCont := range kb.Contacts {
+		if CurrCont.NodeID == oldest.NodeID {
+			Index = Idx
+			break
+		}
+	}
+	if Index < 0 { // gone while we were pinging
+		return
+	}
+	if err == nil && pong.Sender.NodeID == oldest.NodeID {
+		kb.Move2End(Index)
+		kb.seen(kadem, oldest.NodeID)
+		return
+	}
+	kb.remove(oldest.NodeID)
+}
+
+// Note that we just heard from the contact with id.
+func (kb *KBucket) seen(kadem *Kademlia, id ID) {
+	if stats := kb.statsFor(id); stats != nil {
+		stats.LastSeen = kadem.Clock.Now()
+		stats.Failures = 0
+	}
+}
+
+// Drop the contact with id, and let the freshest replacement take its place.
+// Must be called with Locker held.
+func (kb *KBucket) remove(id ID) {
+	for Idx, CurrCont := range kb.Contacts {
+		if CurrCont.NodeID == id {
+			kb.Contacts = append(kb.Contacts[:Idx], kb.Contacts[Idx+1:]...)
+			delete(kb.Stats, id)
+			break
+		}
+	}
+	if n := len(kb.Replacements); n > 0 && len(kb.Contacts) < cap(kb.Contacts) {
+		kb.Contacts = append(kb.Contacts, kb.Replacements[n-1])
+		kb.Replacements = kb.Replacements[:n-1]
+	}
+}
+
 func (kb *KBucket) Move2End(Index int) {
 	contact := kb.Contacts[Index]
 	tmp := append(kb.Contacts[:Index], kb.Contacts[Index+1:]...)
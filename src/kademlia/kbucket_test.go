@@ -0,0 +1,86 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Fill the bucket of self holding other with unreachable contacts, other
+// being the oldest, and return its index.
+func fillBucket(self *Kademlia, other Contact) int {
+	index := GetBucketIndex(self.NodeID.Xor(other.NodeID))
+	Update(self, &other)
+	for i := 1; i < k; i++ {
+		Update(self, &Contact{RandomIDInBucket(self.NodeID, index), net.IPv4(10, 0, 0, 1), uint16(i)})
+	}
+	return index
+}
+
+// Wait for the liveness check started by a newcomer to a full bucket.
+func waitForPing(t *testing.T, bucket *KBucket) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bucket.Locker.Lock()
+		pinging := bucket.pinging
+		bucket.Locker.Unlock()
+		if !pinging {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("liveness check never finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait for every liveness check node started, e.g. before swapping its
+// Transport.
+func waitForPings(t *testing.T, node *Kademlia) {
+	for i := range node.Buckets {
+		waitForPing(t, &node.Buckets[i])
+	}
+}
+
+func TestFullBucketEvictsDeadContact(t *testing.T) {
+	network := NewMemNetwork()
+	self, _ := network.NewKademlia("127.0.0.1:0")
+	dead := Contact{NewRandomID(), net.IPv4(10, 0, 0, 2), 1}
+	index := fillBucket(self, dead)
+	bucket := &self.Buckets[index]
+
+	newcomer := Contact{RandomIDInBucket(self.NodeID, index), net.IPv4(10, 0, 0, 3), 1}
+	Update(self, &newcomer)
+	waitForPing(t, bucket)
+
+	if _, err := self.FindContact(dead.NodeID); err == nil {
+		t.Error("dead contact is still in its bucket")
+	}
+	if _, err := self.FindContact(newcomer.NodeID); err != nil {
+		t.Errorf("newcomer did not replace the dead contact: %v", err)
+	}
+	if len(bucket.Replacements) != 0 {
+		t.Errorf("Was %v, but expected %v", len(bucket.Replacements), 0)
+	}
+}
+
+func TestFullBucketKeepsLiveContact(t *testing.T) {
+	network := NewMemNetwork()
+	self, _ := network.NewKademlia("127.0.0.1:0")
+	live, _ := network.NewKademlia("127.0.0.1:0")
+	index := fillBucket(self, live.SelfContact)
+	bucket := &self.Buckets[index]
+
+	newcomer := Contact{RandomIDInBucket(self.NodeID, index), net.IPv4(10, 0, 0, 3), 1}
+	Update(self, &newcomer)
+	waitForPing(t, bucket)
+
+	bucket.Locker.Lock()
+	defer bucket.Locker.Unlock()
+	if last := bucket.Contacts[len(bucket.Contacts)-1]; last.NodeID != live.NodeID {
+		t.Errorf("Was %v, but expected %v", last.NodeID.AsString(), live.NodeID.AsString())
+	}
+	if len(bucket.Replacements) != 1 || bucket.Replacements[0].NodeID != newcomer.NodeID {
+		t.Errorf("newcomer was not kept as a replacement: %v", bucket.Replacements)
+	}
+}
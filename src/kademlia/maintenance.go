@@ -0,0 +1,82 @@
+package kademlia
+
+// Contains the background work a node does while it runs: refreshing the
+// buckets nobody has looked into for a while, expiring and republishing
+// values (see values.go), and saving the routing table (see persist.go).
+
+import (
+	"context"
+	"time"
+)
+
+// how often the background loop looks for work to do
+const maintenanceTick = time.Minute
+
+// A Clock tells the time. Tests swap in their own to drive maintenance.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (k *Kademlia) startMaintenance() {
+	ctx, cancel := context.WithCancel(context.Background())
+	k.stopMaintenance = cancel
+	k.maintenanceDone = make(chan struct{})
+	go k.maintain(ctx)
+}
+
+func (k *Kademlia) maintain(ctx context.Context) {
+	defer close(k.maintenanceDone)
+	ticker := time.NewTicker(maintenanceTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.RefreshIdleBuckets(ctx)
+			k.ExpireValues()
+			k.RepublishValues(ctx)
+			k.SaveRoutingTable()
+		}
+	}
+}
+
+// Record that a lookup targeted the range of bucket index.
+func (k *Kademlia) touchBucket(index int) {
+	bucket := &k.Buckets[index]
+	bucket.Locker.Lock()
+	bucket.LastLookup = k.Clock.Now()
+	bucket.Locker.Unlock()
+}
+
+// Look up a random ID in the range covered by bucket index, which fills the
+// bucket with whatever nodes live there.
+func (k *Kademlia) RefreshBucket(ctx context.Context, index int) {
+	k.DoIterativeFindNode_Internal(ctx, RandomIDInBucket(k.NodeID, index))
+}
+
+// Refresh every bucket which has not seen a lookup for RefreshInterval, and
+// return how many were refreshed.
+func (k *Kademlia) RefreshIdleBuckets(ctx context.Context) int {
+	now := k.Clock.Now()
+	refreshed := 0
+	for i := range k.Buckets {
+		bucket := &k.Buckets[i]
+		bucket.Locker.Lock()
+		idle := now.Sub(bucket.LastLookup) >= k.RefreshInterval
+		bucket.Locker.Unlock()
+		if !idle {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		k.RefreshBucket(ctx, i)
+		refreshed++
+	}
+	return refreshed
+}
@@ -0,0 +1,65 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	Locker *sync.Mutex
+	now    time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{&sync.Mutex{}, time.Date(2015, 5, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Locker.Lock()
+	defer c.Locker.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Locker.Lock()
+	c.now = c.now.Add(d)
+	c.Locker.Unlock()
+}
+
+// Give node a fake clock, and start all its buckets from the clock's time.
+func useFakeClock(node *Kademlia) *fakeClock {
+	clock := newFakeClock()
+	node.Clock = clock
+	for i := range node.Buckets {
+		node.touchBucket(i)
+	}
+	return clock
+}
+
+func TestRefreshIdleBuckets(t *testing.T) {
+	_, nodes := newTestNetwork(t, 5)
+	node := nodes[1]
+	clock := useFakeClock(node)
+	ctx := context.Background()
+
+	if v := node.RefreshIdleBuckets(ctx); v != 0 {
+		t.Errorf("Was %v buckets refreshed, but expected none", v)
+	}
+	clock.Advance(node.RefreshInterval)
+	if v := node.RefreshIdleBuckets(ctx); v != b {
+		t.Errorf("Was %v buckets refreshed, but expected %v", v, b)
+	}
+	if v := node.RefreshIdleBuckets(ctx); v != 0 {
+		t.Errorf("Was %v buckets refreshed right after a refresh, but expected none", v)
+	}
+
+	// a lookup counts as activity for the bucket it targets
+	clock.Advance(node.RefreshInterval / 2)
+	node.DoIterativeFindNode_Internal(ctx, RandomIDInBucket(node.NodeID, 150))
+	clock.Advance(node.RefreshInterval / 2)
+	if v := node.RefreshIdleBuckets(ctx); v != b-1 {
+		t.Errorf("Was %v buckets refreshed, but expected %v", v, b-1)
+	}
+}
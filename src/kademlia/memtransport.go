@@ -0,0 +1,173 @@
+package kademlia
+
+// Contains an in-memory Transport. Every node created through the same
+// MemNetwork can reach the others by their "host:port" address without any
+// socket being opened, which lets many nodes run inside one test process.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type MemNetwork struct {
+	Locker   *sync.Mutex
+	Nodes    map[string]*KademliaCore
+	Delays   map[string]time.Duration // simulated latency of each node
+	nextPort uint16
+}
+
+func NewMemNetwork() *MemNetwork {
+	n := new(MemNetwork)
+	n.Locker = &sync.Mutex{}
+	n.Nodes = make(map[string]*KademliaCore)
+	n.Delays = make(map[string]time.Duration)
+	n.nextPort = 1
+	return n
+}
+
+// Create a node attached to this network. laddr must be an IP literal with a
+// port; port 0 picks the next unused one.
+func (n *MemNetwork) NewKademlia(laddr string) (*Kademlia, error) {
+	return n.NewKademliaWithConfig(laddr, Config{})
+}
+
+func (n *MemNetwork) NewKademliaWithConfig(laddr string, cfg Config) (*Kademlia, error) {
+	hostname, portstr, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, err
+	}
+	host := net.ParseIP(hostname)
+	if host == nil {
+		return nil, errors.New("not an IP address: " + hostname)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Locker.Lock()
+	defer n.Locker.Unlock()
+	if port == 0 {
+		for {
+			port = uint64(n.nextPort)
+			n.nextPort++
+			if _, ok := n.Nodes[HostAndPortString(host, uint16(port))]; !ok {
+				break
+			}
+		}
+	}
+	peer := HostAndPortString(host, uint16(port))
+	if _, ok := n.Nodes[peer]; ok {
+		return nil, errors.New("address already in use: " + peer)
+	}
+
+	k, err := newKademlia(&memTransport{n, host}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	k.SelfContact = Contact{k.NodeID, host, uint16(port)}
+	n.Nodes[peer] = &KademliaCore{k, nil}
+	k.startMaintenance()
+	return k, nil
+}
+
+// Detach the node listening at peer, as if it had left the network.
+func (n *MemNetwork) Remove(peer string) {
+	n.Locker.Lock()
+	delete(n.Nodes, peer)
+	n.Locker.Unlock()
+}
+
+// Make every RPC to peer take d before it is delivered.
+func (n *MemNetwork) SetDelay(peer string, d time.Duration) {
+	n.Locker.Lock()
+	n.Delays[peer] = d
+	n.Locker.Unlock()
+}
+
+// Find the node at peer, after waiting out its simulated latency. Its
+// handlers see the request coming from host from.
+func (n *MemNetwork) lookup(ctx context.Context, op string, peer string, from net.IP) (*KademliaCore, error) {
+	n.Locker.Lock()
+	kc, ok := n.Nodes[peer]
+	delay := n.Delays[peer]
+	n.Locker.Unlock()
+	if !ok {
+		return nil, newRPCError(op, peer, ErrUnreachable, errors.New("no node listening"))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, newRPCError(op, peer, errorKind(ctx, err), err)
+	}
+	return &KademliaCore{kc.kademlia, from}, nil
+}
+
+// Wrap an error returned by a handler the way net/rpc would.
+func remoteError(op string, peer string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return newRPCError(op, peer, ErrRemote, err)
+}
+
+type memTransport struct {
+	network *MemNetwork
+	host    net.IP // where our requests come from
+}
+
+func (t *memTransport) Ping(ctx context.Context, peer string, req PingMessage, res *PongMessage) error {
+	kc, err := t.network.lookup(ctx, "KademliaCore.Ping", peer, t.host)
+	if err != nil {
+		return err
+	}
+	return remoteError("KademliaCore.Ping", peer, kc.Ping(req, res))
+}
+
+func (t *memTransport) Store(ctx context.Context, peer string, req StoreRequest, res *StoreResult) error {
+	kc, err := t.network.lookup(ctx, "KademliaCore.Store", peer, t.host)
+	if err != nil {
+		return err
+	}
+	// copy the value, as a real connection would
+	req.Value = append([]byte(nil), req.Value...)
+	return remoteError("KademliaCore.Store", peer, kc.Store(req, res))
+}
+
+func (t *memTransport) FindNode(ctx context.Context, peer string, req FindNodeRequest, res *FindNodeResult) error {
+	kc, err := t.network.lookup(ctx, "KademliaCore.FindNode", peer, t.host)
+	if err != nil {
+		return err
+	}
+	return remoteError("KademliaCore.FindNode", peer, kc.FindNode(req, res))
+}
+
+func (t *memTransport) FindValue(ctx context.Context, peer string, req FindValueRequest, res *FindValueResult) error {
+	kc, err := t.network.lookup(ctx, "KademliaCore.FindValue", peer, t.host)
+	if err != nil {
+		return err
+	}
+	err = kc.FindValue(req, res)
+	if res.Value != nil {
+		res.Value = append([]byte(nil), res.Value...)
+	}
+	return remoteError("KademliaCore.FindValue", peer, err)
+}
+
+func (t *memTransport) GetVDO(ctx context.Context, peer string, req GetVDORequest, res *GetVDOResult) error {
+	kc, err := t.network.lookup(ctx, "KademliaCore.GetVDO", peer, t.host)
+	if err != nil {
+		return err
+	}
+	return remoteError("KademliaCore.GetVDO", peer, kc.GetVDO(req, res))
+}
@@ -0,0 +1,96 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemNetworkPingAndStore(t *testing.T) {
+	network := NewMemNetwork()
+	a, err := network.NewKademlia("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := network.NewKademlia("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := a.DoPing(context.Background(), b.SelfContact.Host, b.SelfContact.Port); err != nil || c.NodeID != b.NodeID {
+		t.Fatalf("ping answered by %v, %v", c, err)
+	}
+	if _, err := a.FindContact(b.NodeID); err != nil {
+		t.Errorf("a did not learn b from its pong: %v", err)
+	}
+	if _, err := b.FindContact(a.NodeID); err != nil {
+		t.Errorf("b did not learn a from its ping: %v", err)
+	}
+
+	key := NewRandomID()
+	if err := a.DoStore(context.Background(), &b.SelfContact, key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.LocalFindValue(key); !bytes.Equal(v, []byte("hello")) {
+		t.Errorf("Was %q, but expected %q", v, "hello")
+	}
+}
+
+func TestMemNetworkAddressInUse(t *testing.T) {
+	network := NewMemNetwork()
+	if _, err := network.NewKademlia("127.0.0.1:7890"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.NewKademlia("127.0.0.1:7890"); err == nil {
+		t.Error("Shouldn't have been able to reuse the address")
+	}
+}
+
+func TestMemNetworkUnreachable(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	var pong PongMessage
+	err := a.Transport.Ping(context.Background(), "127.0.0.1:1234", PingMessage{a.SelfContact, NewRandomID()}, &pong)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Was %v, but expected %v", err, ErrUnreachable)
+	}
+}
+
+func TestMemNetworkDeadline(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	b, _ := network.NewKademlia("127.0.0.1:0")
+	network.SetDelay(HostAndPortString(b.SelfContact.Host, b.SelfContact.Port), time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := a.DoPing(ctx, b.SelfContact.Host, b.SelfContact.Port)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Was %v, but expected %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ping took %v, the deadline was not honoured", elapsed)
+	}
+}
+
+// Build a network of n nodes which all know the first one.
+func newTestNetwork(t *testing.T, n int) (*MemNetwork, []*Kademlia) {
+	network := NewMemNetwork()
+	nodes := make([]*Kademlia, n)
+	for i := range nodes {
+		node, err := network.NewKademlia("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+		if i > 0 {
+			if _, err := node.DoPing(context.Background(), nodes[0].SelfContact.Host, nodes[0].SelfContact.Port); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return network, nodes
+}
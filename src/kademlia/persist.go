@@ -0,0 +1,113 @@
+package kademlia
+
+// Contains what a node keeps in its data directory so that it survives a
+// restart: its ID, a snapshot of the contacts in its buckets, and the log of
+// its stored values.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeIDFile   = "node_id"
+	contactsFile = "contacts"
+	valuesFile   = "values.log"
+)
+
+// Write data to path so that a crash leaves either the old or the new file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Read our ID from dir, generating and saving a new one the first time.
+func loadNodeID(dir string) (ID, error) {
+	path := filepath.Join(dir, nodeIDFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		id := NewRandomID()
+		return id, writeFileAtomic(path, []byte(id.AsString()+"\n"))
+	}
+	if err != nil {
+		return ID{}, err
+	}
+	str := strings.TrimSpace(string(data))
+	if len(str) != 2*IDBytes {
+		return ID{}, errors.New(path + ": not a node ID")
+	}
+	return IDFromString(str)
+}
+
+// Read the contacts saved by SaveRoutingTable. A missing file means none.
+func loadContacts(dir string) ([]Contact, error) {
+	f, err := os.Open(filepath.Join(dir, contactsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var contacts []Contact
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) != 2*IDBytes {
+			continue // skip anything we cannot make sense of
+		}
+		id, err := IDFromString(fields[0])
+		if err != nil {
+			continue
+		}
+		host, port, err := ParseHostAndPort(fields[1])
+		if err != nil {
+			continue
+		}
+		contacts = append(contacts, Contact{id, host, port})
+	}
+	return contacts, scanner.Err()
+}
+
+// Save the contacts in our buckets to the data directory, one
+// "<node ID> <host:port>" per line. Does nothing without a data directory.
+func (k *Kademlia) SaveRoutingTable() error {
+	if k.DataDir == "" {
+		return nil
+	}
+	var lines []string
+	for i := range k.Buckets {
+		bucket := &k.Buckets[i]
+		bucket.Locker.Lock()
+		for _, c := range bucket.Contacts {
+			// JoinHostPort brackets IPv6 hosts, as loadContacts expects
+			addr := net.JoinHostPort(c.Host.String(), strconv.Itoa(int(c.Port)))
+			lines = append(lines, c.NodeID.AsString()+" "+addr+"\n")
+		}
+		bucket.Locker.Unlock()
+	}
+	return writeFileAtomic(filepath.Join(k.DataDir, contactsFile), []byte(strings.Join(lines, "")))
+}
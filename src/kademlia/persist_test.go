@@ -0,0 +1,96 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRestartKeepsIdentityAndContacts(t *testing.T) {
+	network, nodes := newTestNetwork(t, 4)
+	dir := t.TempDir()
+	node, err := network.NewKademliaWithConfig("127.0.0.1:9000", Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := nodes[0]
+	if err := node.Bootstrap(context.Background(), HostAndPortString(seed.SelfContact.Host, seed.SelfContact.Port)); err != nil {
+		t.Fatal(err)
+	}
+	id := node.NodeID
+	if err := node.Close(); err != nil {
+		t.Fatal(err)
+	}
+	network.Remove("127.0.0.1:9000")
+
+	node, err = network.NewKademliaWithConfig("127.0.0.1:9000", Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	if node.NodeID != id {
+		t.Errorf("Was %v, but expected %v", node.NodeID.AsString(), id.AsString())
+	}
+	if len(node.savedContacts) != 4 {
+		t.Errorf("Was %v, but expected %v", len(node.savedContacts), 4)
+	}
+	if err := node.Rejoin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range node.savedContacts {
+		if _, err := node.FindContact(c.NodeID); err != nil {
+			t.Errorf("did not get %v back: %v", c.NodeID.AsString(), err)
+		}
+	}
+}
+
+func TestSaveRoutingTableIPv6(t *testing.T) {
+	network := NewMemNetwork()
+	dir := t.TempDir()
+	node, err := network.NewKademliaWithConfig("127.0.0.1:0", Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	contacts := []Contact{
+		{NewRandomID(), net.ParseIP("::1"), 7890},
+		{NewRandomID(), net.IPv4(10, 0, 0, 1), 7891},
+	}
+	for i := range contacts {
+		Update(node, &contacts[i])
+	}
+	if err := node.SaveRoutingTable(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(contacts) {
+		t.Fatalf("Was %v contacts, but expected %v", len(loaded), len(contacts))
+	}
+	for _, want := range contacts {
+		found := false
+		for _, c := range loaded {
+			if c.NodeID == want.NodeID && c.Host.Equal(want.Host) && c.Port == want.Port {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%v at %v was not loaded back", want.NodeID.AsString(), want.Host)
+		}
+	}
+}
+
+func TestRejoinWithoutSavedContacts(t *testing.T) {
+	network := NewMemNetwork()
+	node, err := network.NewKademliaWithConfig("127.0.0.1:0", Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	if err := node.Rejoin(context.Background()); !errors.Is(err, ErrNoSeed) {
+		t.Errorf("Was %v, but expected %v", err, ErrNoSeed)
+	}
+}
@@ -0,0 +1,134 @@
+package kademlia
+
+// Contains quorum reads: an iterative FIND_VALUE which collects the value
+// from ReadQuorum different holders, and the Resolvers which pick one value
+// when their copies disagree.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"time"
+)
+
+// One holder's copy of a value.
+type ValueCopy struct {
+	Holder      Contact
+	Value       []byte
+	Publisher   ID
+	PublishedAt time.Time
+}
+
+// A Resolver picks the copy to believe out of those a quorum read collected,
+// or fails with ErrConflict.
+type Resolver interface {
+	Resolve(key ID, copies []ValueCopy) (ValueCopy, error)
+}
+
+// MajorityResolver picks the value most holders sent. A tie is a conflict.
+type MajorityResolver struct{}
+
+func (MajorityResolver) Resolve(key ID, copies []ValueCopy) (ValueCopy, error) {
+	best, bestVotes, tied := -1, 0, false
+	for i := range copies {
+		votes := 0
+		for j := range copies {
+			if bytes.Equal(copies[i].Value, copies[j].Value) {
+				votes++
+			}
+		}
+		switch {
+		case votes > bestVotes:
+			best, bestVotes, tied = i, votes, false
+		case votes == bestVotes && !bytes.Equal(copies[i].Value, copies[best].Value):
+			tied = true
+		}
+	}
+	if best < 0 || tied {
+		return ValueCopy{}, fmt.Errorf("%w: no majority among %v copies", ErrConflict, len(copies))
+	}
+	return copies[best], nil
+}
+
+// NewestResolver picks the most recently published value. Different values
+// published at the same time are a conflict.
+type NewestResolver struct{}
+
+func (NewestResolver) Resolve(key ID, copies []ValueCopy) (ValueCopy, error) {
+	best, tied := -1, false
+	for i := range copies {
+		switch {
+		case best < 0 || copies[i].PublishedAt.After(copies[best].PublishedAt):
+			best, tied = i, false
+		case copies[i].PublishedAt.Equal(copies[best].PublishedAt) && !bytes.Equal(copies[i].Value, copies[best].Value):
+			tied = true
+		}
+	}
+	if best < 0 || tied {
+		return ValueCopy{}, fmt.Errorf("%w: no single newest among %v copies", ErrConflict, len(copies))
+	}
+	return copies[best], nil
+}
+
+// HashResolver picks a value whose ContentKey is the key it is stored under,
+// for content-addressed values. No such value is a conflict.
+type HashResolver struct{}
+
+func (HashResolver) Resolve(key ID, copies []ValueCopy) (ValueCopy, error) {
+	for _, c := range copies {
+		if ContentKey(c.Value) == key {
+			return c, nil
+		}
+	}
+	return ValueCopy{}, fmt.Errorf("%w: none of %v copies matches its key", ErrConflict, len(copies))
+}
+
+// Return the key of a content-addressed value: its SHA-1.
+func ContentKey(value []byte) ID {
+	return ID(sha1.Sum(value))
+}
+
+// What a quorum read found. Value and Holder are the resolved copy; the
+// Disagreements are the copies holding a different value.
+type ReadReport struct {
+	Value         []byte
+	Holder        Contact
+	Copies        []ValueCopy
+	Disagreements []ValueCopy
+}
+
+// Run an iterative FIND_VALUE for key which only stops once ReadQuorum nodes
+// have sent the value, and resolve their copies with Resolver. It fails with
+// ErrQuorum when fewer nodes hold the value, and with ErrConflict when the
+// Resolver cannot decide; the report still lists the copies found.
+func (K *Kademlia) DoQuorumFindValue(ctx context.Context, key ID) (ReadReport, error) {
+	l := K.newLookup(key, true)
+	l.Quorum = K.ReadQuorum
+	l.run(ctx)
+
+	var report ReadReport
+	for _, found := range l.Found {
+		report.Copies = append(report.Copies, ValueCopy{found.Contact, found.Value, found.Publisher, found.PublishedAt})
+	}
+	if len(report.Copies) == 0 {
+		if ctx.Err() != nil {
+			return report, ctxError(ctx)
+		}
+		return report, &NotFoundError{key, "value not found"}
+	}
+	if len(report.Copies) < K.ReadQuorum {
+		return report, fmt.Errorf("%w: %v of %v holders found", ErrQuorum, len(report.Copies), K.ReadQuorum)
+	}
+	chosen, err := K.Resolver.Resolve(key, report.Copies)
+	if err != nil {
+		return report, err
+	}
+	report.Value, report.Holder = chosen.Value, chosen.Holder
+	for _, c := range report.Copies {
+		if !bytes.Equal(c.Value, chosen.Value) {
+			report.Disagreements = append(report.Disagreements, c)
+		}
+	}
+	return report, nil
+}
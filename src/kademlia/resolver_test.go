@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolvers(t *testing.T) {
+	now := time.Now()
+	key := ContentKey([]byte("good"))
+	copies := []ValueCopy{
+		{Value: []byte("good"), PublishedAt: now},
+		{Value: []byte("good"), PublishedAt: now},
+		{Value: []byte("bad"), PublishedAt: now.Add(time.Second)},
+	}
+	tests := []struct {
+		resolver Resolver
+		want     string
+	}{
+		{MajorityResolver{}, "good"},
+		{NewestResolver{}, "bad"},
+		{HashResolver{}, "good"},
+	}
+	for _, test := range tests {
+		c, err := test.resolver.Resolve(key, copies)
+		if err != nil || string(c.Value) != test.want {
+			t.Errorf("%T: Was %q, %v, but expected %q", test.resolver, c.Value, err, test.want)
+		}
+	}
+
+	// one vote each, published at once, none matching the key
+	tied := []ValueCopy{{Value: []byte("a"), PublishedAt: now}, {Value: []byte("b"), PublishedAt: now}}
+	for _, resolver := range []Resolver{MajorityResolver{}, NewestResolver{}, HashResolver{}} {
+		if _, err := resolver.Resolve(key, tied); !errors.Is(err, ErrConflict) {
+			t.Errorf("%T: Was %v, but expected %v", resolver, err, ErrConflict)
+		}
+	}
+}
+
+func TestQuorumFindValue(t *testing.T) {
+	_, nodes := newTestNetwork(t, 6)
+	key := NewRandomID()
+	for _, holder := range nodes[1:4] {
+		if err := nodes[0].DoStore(context.Background(), &holder.SelfContact, key, []byte("good")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[0].DoStore(context.Background(), &nodes[4].SelfContact, key, []byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := nodes[5]
+	reader.ReadQuorum = 4
+	report, err := reader.DoQuorumFindValue(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(report.Value) != "good" {
+		t.Errorf("Was %q, but expected %q", report.Value, "good")
+	}
+	if len(report.Copies) != 4 {
+		t.Errorf("Was %v copies, but expected %v", len(report.Copies), 4)
+	}
+	if len(report.Disagreements) != 1 || report.Disagreements[0].Holder.NodeID != nodes[4].NodeID {
+		t.Errorf("Was %v, but expected only %s to disagree", report.Disagreements, nodes[4].NodeID.AsString())
+	}
+
+	reader.ReadQuorum = 5
+	if _, err := reader.DoQuorumFindValue(context.Background(), key); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Was %v, but expected %v", err, ErrQuorum)
+	}
+}
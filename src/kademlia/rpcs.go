@@ -5,12 +5,27 @@ package kademlia
 // other groups' code.
 
 import (
-	"fmt"
 	"net"
+	"time"
 )
 
+// Serves the RPCs of one connection. remote is the host the connection
+// comes from, against which senders are checked; nil trusts every sender.
 type KademliaCore struct {
 	kademlia *Kademlia
+	remote   net.IP
+}
+
+// Add the sender of a request to our buckets, unless it claims a host other
+// than the one the request comes from: nobody gets to put forged contacts in
+// our routing table. The request is served either way, as an honest node
+// may advertise another address than it calls from, e.g. on a multi-homed
+// machine.
+func (kc *KademliaCore) learn(sender Contact) {
+	if kc.remote != nil && !sender.Host.Equal(kc.remote) {
+		return
+	}
+	Update(kc.kademlia, &sender)
 }
 
 // Host identification.
@@ -35,9 +50,9 @@ type PongMessage struct {
 
 func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 
+	kc.learn(ping.Sender)
 	pong.MsgID = CopyID(ping.MsgID)
 	pong.Sender = kc.kademlia.SelfContact
-	Update(kc.kademlia, &ping.Sender)
 
 	return nil
 }
@@ -50,6 +65,13 @@ type StoreRequest struct {
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	// The original publisher and publication time, kept as the value is
+	// republished. A zero PublishedAt means "published now by Sender".
+	Publisher   ID
+	PublishedAt time.Time
+	// Non-zero for a copy cached along a lookup path, which is kept until
+	// then at most and never republished.
+	CacheUntil time.Time
 }
 
 type StoreResult struct {
@@ -58,9 +80,26 @@ type StoreResult struct {
 }
 
 func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
+	kc.learn(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
-	kc.kademlia.Values[req.Key] = req.Value
-	return nil
+	k := kc.kademlia
+	sv := StoredValue{Value: req.Value, Publisher: req.Publisher, PublishedAt: req.PublishedAt}
+	if sv.PublishedAt.IsZero() {
+		sv.Publisher = req.Sender.NodeID
+		sv.PublishedAt = k.Clock.Now()
+	}
+	// a publication time in the future would keep the value past its expiry
+	if now := k.Clock.Now(); sv.PublishedAt.After(now) {
+		sv.PublishedAt = now
+	}
+	sv.ExpiresAt = sv.PublishedAt.Add(k.ExpireInterval)
+	if !req.CacheUntil.IsZero() {
+		sv.Cached = true
+		if req.CacheUntil.Before(sv.ExpiresAt) {
+			sv.ExpiresAt = req.CacheUntil
+		}
+	}
+	return k.storeLocal(req.Key, sv)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -79,64 +118,31 @@ type FindNodeResult struct {
 }
 
 func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error {
+	kc.learn(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
-	res.Nodes = FindKClosestContacts(kc.kademlia, req.NodeID)
+	res.Nodes = FindKClosestContacts(kc.kademlia, req.NodeID, req.Sender.NodeID)
 	return nil
 }
 
-func FindKClosestContacts(kademlia *Kademlia, req_id ID) (contacts []Contact) {
-	contacts = make([]Contact, 0)
-	distance := kademlia.NodeID.Xor(req_id)
-	var search_bucket []int
-
-	if kademlia.NodeID == req_id {
-		search_bucket = make([]int, 160)
-		contacts = append(contacts, kademlia.SelfContact)
-		for index := range search_bucket {
-			search_bucket[index] = index
-		}
-	} else {
-		search_bucket = GetBucketsToSearch(distance)
-	}
-
-	for index := range search_bucket {
-		is_k_contacts := AddNodes(kademlia, index, req_id, &contacts)
-		if is_k_contacts {
-			return contacts
-		}
-	}
-
-	return
-}
-
-func GetBucketsToSearch(dist ID) []int {
-	//creates indices on buckets to search based on which bits are set in the distance
-	search_indices := make([]int, 0)
-	for i := IDBytes - 1; i >= 0; i-- {
-		for j := 7; j >= 0; j-- {
-			if (dist[i]>>uint8(j))&0x1 != 0 {
-				search_indices = append(search_indices, (8*IDBytes)-(8*i+j)-1)
+// Return the k contacts from our buckets closest to target, sorted by
+// distance, never including requester.
+func FindKClosestContacts(kademlia *Kademlia, target ID, requester ID) []Contact {
+	contacts := make([]Contact, 0, k)
+	for i := range kademlia.Buckets {
+		bucket := &kademlia.Buckets[i]
+		bucket.Locker.Lock()
+		for _, contact := range bucket.Contacts {
+			if contact.NodeID != requester {
+				contacts = append(contacts, contact)
 			}
 		}
+		bucket.Locker.Unlock()
 	}
-	return search_indices
-}
-
-func AddNodes(kd *Kademlia, index int, req_id ID, close_contacts *[]Contact) bool {
-	is_k_contacts := false
-	list_contacts := kd.Buckets[index].Contacts
-	if len(list_contacts) == 0 {
-		return false
+	sortByDistance(contacts, target)
+	if len(contacts) > k {
+		contacts = contacts[:k]
 	}
-
-	for _, contact := range list_contacts {
-		*close_contacts = append(*close_contacts, contact)
-		if len(*close_contacts) == k {
-			is_k_contacts = true
-			return is_k_contacts
-		}
-	}
-	return is_k_contacts
+	return contacts
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -153,17 +159,27 @@ type FindValueRequest struct {
 type FindValueResult struct {
 	MsgID ID
 	Value []byte
-	Nodes []Contact
-	Err   error
+	// who published Value, and when
+	Publisher   ID
+	PublishedAt time.Time
+	Nodes       []Contact
+	Err         error
 }
 
 func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
+	kc.learn(req.Sender)
 	res.MsgID = CopyID(req.MsgID)
-	if val, ok := kc.kademlia.Values[req.Key]; ok {
-		res.Value = val
+	sv, ok, err := kc.kademlia.findLocal(req.Key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		res.Value = sv.Value
+		res.Publisher = sv.Publisher
+		res.PublishedAt = sv.PublishedAt
 	} else {
 		res.Value = nil
-		res.Nodes = FindKClosestContacts(kc.kademlia, req.Key)
+		res.Nodes = FindKClosestContacts(kc.kademlia, req.Key, req.Sender.NodeID)
 	}
 
 	return nil
@@ -182,12 +198,11 @@ type GetVDOResult struct {
 
 func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
 	// fill in
+	kc.learn(req.Sender)
 	kc.kademlia.VDOS_Lock.Lock()
 	res.MsgID = CopyID(req.MsgID)
 	if val, ok := kc.kademlia.VDOS[req.VdoID]; ok {
 		res.VDO = val
-	} else {
-		fmt.Printf("not found")
 	}
 	kc.kademlia.VDOS_Lock.Unlock()
 	return nil
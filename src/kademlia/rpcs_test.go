@@ -0,0 +1,94 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestFindKClosestContacts(t *testing.T) {
+	network := NewMemNetwork()
+	node, _ := network.NewKademlia("127.0.0.1:0")
+	var known []Contact
+	// fill ten buckets exactly, so no eviction check changes them under us
+	for i := 0; i < 10*k; i++ {
+		c := Contact{RandomIDInBucket(node.NodeID, b-1-i/k), net.IPv4(127, 0, 0, 1), uint16(10000 + i)}
+		Update(node, &c)
+	}
+	for i := range node.Buckets {
+		known = append(known, node.Buckets[i].Contacts...)
+	}
+
+	for i := 0; i < 20; i++ {
+		target := NewRandomID()
+		requester := known[i]
+		result := FindKClosestContacts(node, target, requester.NodeID)
+		if len(result) != k {
+			t.Fatalf("Was %v contacts, but expected %v", len(result), k)
+		}
+
+		// brute force: every known contact but the requester, by distance
+		want := make([]Contact, 0, len(known))
+		for _, c := range known {
+			if c.NodeID != requester.NodeID {
+				want = append(want, c)
+			}
+		}
+		sortByDistance(want, target)
+		for j := range result {
+			if result[j].NodeID != want[j].NodeID {
+				t.Errorf("contact #%v was %s, but expected %s", j, result[j].NodeID.AsString(), want[j].NodeID.AsString())
+			}
+		}
+	}
+}
+
+func TestFindKClosestContactsOwnID(t *testing.T) {
+	_, nodes := newTestNetwork(t, 3)
+	// nodes[0] knows the other two; asking for our own ID must not return us
+	for _, c := range FindKClosestContacts(nodes[0], nodes[1].NodeID, nodes[1].NodeID) {
+		if c.NodeID == nodes[1].NodeID {
+			t.Error("the requester was returned to itself")
+		}
+	}
+}
+
+func TestHandlersLearnSender(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	b, _ := network.NewKademlia("127.0.0.1:0")
+	c, _ := network.NewKademlia("127.0.0.1:0")
+	if _, _, err := a.DoFindValue(context.Background(), &b.SelfContact, NewRandomID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.FindContact(a.NodeID); err != nil {
+		t.Errorf("b did not learn a from its FIND_VALUE: %v", err)
+	}
+	// the sender of a STORE is a, not c itself
+	if err := a.DoStore(context.Background(), &c.SelfContact, NewRandomID(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FindContact(a.NodeID); err != nil {
+		t.Errorf("c did not learn a from its STORE: %v", err)
+	}
+}
+
+func TestForgedSenderNotLearned(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	b, _ := network.NewKademlia("127.0.0.1:0")
+	Update(b, &a.SelfContact)
+	forged := Contact{NewRandomID(), net.IPv4(10, 0, 0, 1), 7890}
+	var res FindNodeResult
+	err := a.Transport.FindNode(context.Background(), HostAndPortString(b.SelfContact.Host, b.SelfContact.Port),
+		FindNodeRequest{forged, NewRandomID(), NewRandomID()}, &res)
+	if err != nil {
+		t.Fatalf("the request was not served: %v", err)
+	}
+	if len(res.Nodes) != 1 || res.Nodes[0].NodeID != a.NodeID {
+		t.Errorf("Was %v, but expected [%v]", res.Nodes, a.SelfContact)
+	}
+	if _, err := b.FindContact(forged.NodeID); err == nil {
+		t.Error("b learned a forged contact")
+	}
+}
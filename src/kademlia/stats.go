@@ -0,0 +1,113 @@
+package kademlia
+
+// Contains what a node records about each contact in its buckets, so that it
+// can tell a flaky peer from a healthy one. Every RPC we make updates the
+// record of its target; a contact which fails MaxFailures RPCs in a row is
+// evicted in favour of the freshest replacement.
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type ContactStats struct {
+	Contact  Contact
+	LastSeen time.Time     // when we last heard from it, by Clock
+	RTT      time.Duration // smoothed round trip time; zero until measured
+	Failures int           // RPCs failed in a row
+}
+
+// Return the record of the contact with id, creating it if needed. Returns
+// nil when id is not in the bucket. Must be called with Locker held.
+func (kb *KBucket) statsFor(id ID) *ContactStats {
+	if stats, ok := kb.Stats[id]; ok {
+		return stats
+	}
+	for _, c := range kb.Contacts {
+		if c.NodeID == id {
+			stats := &ContactStats{Contact: c}
+			kb.Stats[id] = stats
+			return stats
+		}
+	}
+	return nil
+}
+
+// Record the outcome of an RPC to contact started at start. An answer, even
+// an error, means the contact is alive; a call we cancelled ourselves says
+// nothing about it.
+func (k *Kademlia) recordRPC(contact Contact, start time.Time, err error) {
+	if err == nil || errors.Is(err, ErrRemote) {
+		Update(k, &contact)
+	}
+	if errors.Is(err, context.Canceled) || contact.NodeID == k.NodeID {
+		return
+	}
+	bucket := &k.Buckets[GetBucketIndex(k.NodeID.Xor(contact.NodeID))]
+	bucket.Locker.Lock()
+	defer bucket.Locker.Unlock()
+	stats := bucket.statsFor(contact.NodeID)
+	if stats == nil { // waiting in the replacement cache, or forgotten
+		return
+	}
+	if err == nil {
+		// the same smoothing as TCP's SRTT
+		sample := time.Since(start)
+		if stats.RTT == 0 {
+			stats.RTT = sample
+		} else {
+			stats.RTT = (7*stats.RTT + sample) / 8
+		}
+		return
+	}
+	if errors.Is(err, ErrRemote) {
+		return
+	}
+	stats.Failures++
+	if stats.Failures >= k.MaxFailures {
+		bucket.remove(contact.NodeID)
+	}
+}
+
+// Return the smoothed RTT of the contact with id, or zero if it is not in our
+// buckets or was never measured.
+func (k *Kademlia) rttOf(id ID) time.Duration {
+	bucket := &k.Buckets[GetBucketIndex(k.NodeID.Xor(id))]
+	bucket.Locker.Lock()
+	defer bucket.Locker.Unlock()
+	if stats, ok := bucket.Stats[id]; ok {
+		return stats.RTT
+	}
+	return 0
+}
+
+// Find the contact listening at peer in our buckets.
+func (k *Kademlia) contactAt(peer string) (Contact, bool) {
+	for i := range k.Buckets {
+		bucket := &k.Buckets[i]
+		bucket.Locker.Lock()
+		for _, c := range bucket.Contacts {
+			if HostAndPortString(c.Host, c.Port) == peer {
+				bucket.Locker.Unlock()
+				return c, true
+			}
+		}
+		bucket.Locker.Unlock()
+	}
+	return Contact{}, false
+}
+
+// Return the records of every contact in our buckets, closest bucket first.
+func (k *Kademlia) ContactStats() []ContactStats {
+	var all []ContactStats
+	for i := range k.Buckets {
+		bucket := &k.Buckets[i]
+		bucket.Locker.Lock()
+		for _, c := range bucket.Contacts {
+			all = append(all, *bucket.statsFor(c.NodeID))
+		}
+		bucket.Locker.Unlock()
+	}
+	return all
+}
@@ -0,0 +1,40 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContactStats(t *testing.T) {
+	network := NewMemNetwork()
+	a, _ := network.NewKademlia("127.0.0.1:0")
+	b, _ := network.NewKademlia("127.0.0.1:0")
+	peer := HostAndPortString(b.SelfContact.Host, b.SelfContact.Port)
+	network.SetDelay(peer, 5*time.Millisecond)
+
+	if _, err := a.DoPing(context.Background(), b.SelfContact.Host, b.SelfContact.Port); err != nil {
+		t.Fatal(err)
+	}
+	stats := a.ContactStats()
+	if len(stats) != 1 || stats[0].Contact.NodeID != b.NodeID {
+		t.Fatalf("Was %v, but expected only %v", stats, b.NodeID.AsString())
+	}
+	if stats[0].LastSeen.IsZero() || stats[0].RTT < 5*time.Millisecond || stats[0].Failures != 0 {
+		t.Errorf("unexpected stats after a ping: %+v", stats[0])
+	}
+
+	// b leaves; it is evicted once it failed MaxFailures RPCs in a row
+	network.Remove(peer)
+	for i := 1; i <= a.MaxFailures; i++ {
+		if _, err := a.DoFindNode(context.Background(), &b.SelfContact, NewRandomID()); err == nil {
+			t.Fatal("b answered after leaving")
+		}
+		if _, err := a.FindContact(b.NodeID); (err == nil) != (i < a.MaxFailures) {
+			t.Errorf("after %v failures, FindContact returned %v", i, err)
+		}
+	}
+	if stats := a.ContactStats(); len(stats) != 0 {
+		t.Errorf("Was %v, but expected no contacts", stats)
+	}
+}
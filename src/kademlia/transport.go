@@ -0,0 +1,134 @@
+package kademlia
+
+// Contains the Transport abstraction used for every outgoing RPC. Kademlia
+// never dials a peer itself; it hands the request to its Transport, which
+// knows how to reach the peer's KademliaCore. Also contains the server side
+// of HTTPTransport.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+// A Transport delivers requests to the KademliaCore of the peer listening at
+// the given "host:port" address and fills in the result. It gives up as soon
+// as ctx is done. Failures are returned as an *RPCError.
+type Transport interface {
+	Ping(ctx context.Context, peer string, req PingMessage, res *PongMessage) error
+	Store(ctx context.Context, peer string, req StoreRequest, res *StoreResult) error
+	FindNode(ctx context.Context, peer string, req FindNodeRequest, res *FindNodeResult) error
+	FindValue(ctx context.Context, peer string, req FindValueRequest, res *FindValueResult) error
+	GetVDO(ctx context.Context, peer string, req GetVDORequest, res *GetVDOResult) error
+}
+
+// HTTPTransport is the default Transport. It speaks net/rpc over HTTP,
+// opening one connection per call.
+type HTTPTransport struct{}
+
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{}
+}
+
+// Same handshake as rpc.DialHTTP, but the dial and the handshake honour ctx.
+func dialHTTP(ctx context.Context, peer string) (*rpc.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", peer)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// a cancelled ctx has no deadline to set: interrupt the handshake instead
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (t *HTTPTransport) call(ctx context.Context, peer string, method string, req interface{}, res interface{}) error {
+	client, err := dialHTTP(ctx, peer)
+	if err != nil {
+		return newRPCError(method, peer, errorKind(ctx, err), err)
+	}
+	// closing the client also aborts a call still in flight
+	defer client.Close()
+	call := client.Go(method, req, res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return newRPCError(method, peer, errorKind(ctx, err), err)
+	}
+	return nil
+}
+
+func (t *HTTPTransport) Ping(ctx context.Context, peer string, req PingMessage, res *PongMessage) error {
+	return t.call(ctx, peer, "KademliaCore.Ping", req, res)
+}
+
+func (t *HTTPTransport) Store(ctx context.Context, peer string, req StoreRequest, res *StoreResult) error {
+	return t.call(ctx, peer, "KademliaCore.Store", req, res)
+}
+
+func (t *HTTPTransport) FindNode(ctx context.Context, peer string, req FindNodeRequest, res *FindNodeResult) error {
+	return t.call(ctx, peer, "KademliaCore.FindNode", req, res)
+}
+
+func (t *HTTPTransport) FindValue(ctx context.Context, peer string, req FindValueRequest, res *FindValueResult) error {
+	return t.call(ctx, peer, "KademliaCore.FindValue", req, res)
+}
+
+func (t *HTTPTransport) GetVDO(ctx context.Context, peer string, req GetVDORequest, res *GetVDOResult) error {
+	return t.call(ctx, peer, "KademliaCore.GetVDO", req, res)
+}
+
+// Serves net/rpc over HTTP like rpc.Server.ServeHTTP, except that each
+// connection gets a KademliaCore knowing the host it comes from.
+type rpcHandler struct {
+	kademlia *Kademlia
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server := rpc.NewServer()
+	if err := server.Register(&KademliaCore{h.kademlia, net.ParseIP(host)}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("rpc hijacking %v: %v\n", req.RemoteAddr, err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	server.ServeConn(conn)
+}
@@ -0,0 +1,116 @@
+package kademlia
+
+// Contains the values a node stores for the network, and the rules from the
+// Kademlia spec for keeping them alive: every node republishes what it holds
+// to the k closest nodes every RepublishInterval, and a value expires
+// ExpireInterval after its original publication.
+
+import (
+	"context"
+	"time"
+)
+
+type StoredValue struct {
+	Value         []byte
+	Publisher     ID        // node which originally published the value
+	PublishedAt   time.Time // when it was originally published
+	ExpiresAt     time.Time
+	ReceivedAt    time.Time // when we last got a STORE for it
+	RepublishedAt time.Time // when we last republished it ourselves
+	Cached        bool      // a copy cached along a lookup path, see CacheUntil
+}
+
+func (sv *StoredValue) Expired(now time.Time) bool {
+	return !now.Before(sv.ExpiresAt)
+}
+
+// Keep value under key, unless it has already expired. A cached copy never
+// replaces one we hold for real.
+func (k *Kademlia) storeLocal(key ID, sv StoredValue) error {
+	now := k.Clock.Now()
+	if sv.Expired(now) {
+		return nil
+	}
+	sv.ReceivedAt = now
+	k.Values_Lock.Lock()
+	defer k.Values_Lock.Unlock()
+	old, ok, err := k.Values.Get(key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if sv.Cached && !old.Cached && !old.Expired(now) {
+			return nil
+		}
+		sv.RepublishedAt = old.RepublishedAt
+	}
+	return k.Values.Put(key, sv)
+}
+
+// Return the value stored under key, if we have one that has not expired.
+func (k *Kademlia) findLocal(key ID) (StoredValue, bool, error) {
+	sv, ok, err := k.Values.Get(key)
+	if err != nil || !ok || sv.Expired(k.Clock.Now()) {
+		return StoredValue{}, false, err
+	}
+	return sv, true, nil
+}
+
+// Drop every expired value and return how many there were.
+func (k *Kademlia) ExpireValues() int {
+	now := k.Clock.Now()
+	var expired []ID
+	k.Values.Iterate(func(key ID, sv StoredValue) bool {
+		if sv.Expired(now) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	count := 0
+	k.Values_Lock.Lock()
+	defer k.Values_Lock.Unlock()
+	for _, key := range expired {
+		// it may have been stored again since we looked
+		if sv, ok, err := k.Values.Get(key); err != nil || !ok || !sv.Expired(now) {
+			continue
+		}
+		if k.Values.Delete(key) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Republish every value, except cached copies, that neither we nor anybody
+// else has stored in the last RepublishInterval to the k closest nodes of its
+// key, keeping its original publisher and timestamp. Return how many values
+// were republished.
+func (k *Kademlia) RepublishValues(ctx context.Context) int {
+	now := k.Clock.Now()
+	due := make(map[ID]StoredValue)
+	k.Values.Iterate(func(key ID, sv StoredValue) bool {
+		// somebody else republished it to us recently, so the other
+		// holders have it too
+		if !sv.Expired(now) && !sv.Cached && now.Sub(sv.ReceivedAt) >= k.RepublishInterval &&
+			now.Sub(sv.RepublishedAt) >= k.RepublishInterval {
+			due[key] = sv
+		}
+		return true
+	})
+
+	republished := 0
+	for key, sv := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		k.storeAll(ctx, k.DoIterativeFindNode_Internal(ctx, key), key, sv)
+		k.Values_Lock.Lock()
+		if cur, ok, err := k.Values.Get(key); err == nil && ok {
+			cur.RepublishedAt = now
+			k.Values.Put(key, cur)
+		}
+		k.Values_Lock.Unlock()
+		republished++
+	}
+	return republished
+}
@@ -0,0 +1,147 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Build a network of n nodes which all know each other and share one clock.
+func newMeshNetwork(t *testing.T, n int) ([]*Kademlia, *fakeClock) {
+	_, nodes := newTestNetwork(t, n)
+	clock := newFakeClock()
+	for _, a := range nodes {
+		a.Clock = clock
+		for _, b := range nodes {
+			if a != b {
+				Update(a, &b.SelfContact)
+			}
+		}
+	}
+	return nodes, clock
+}
+
+func TestRepublishAndExpire(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 6)
+	ctx := context.Background()
+	key := NewRandomID()
+	if err := nodes[0].DoStore(ctx, &nodes[1].SelfContact, key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(nodes[1].RepublishInterval / 2)
+	if v := nodes[1].RepublishValues(ctx); v != 0 {
+		t.Errorf("Was %v values republished, but expected none so soon after the store", v)
+	}
+	clock.Advance(nodes[1].RepublishInterval / 2)
+	if v := nodes[1].RepublishValues(ctx); v != 1 {
+		t.Errorf("Was %v values republished, but expected 1", v)
+	}
+	for _, node := range nodes[1:] {
+		sv, ok, _ := node.findLocal(key)
+		if !ok {
+			t.Errorf("%s did not get the republished value", node.NodeID.AsString())
+			continue
+		}
+		if sv.Publisher != nodes[0].NodeID {
+			t.Errorf("republishing changed the publisher to %s", sv.Publisher.AsString())
+		}
+	}
+
+	// 24h after the original publication the value is gone everywhere,
+	// however recently it was republished
+	clock.Advance(nodes[1].ExpireInterval - nodes[1].RepublishInterval)
+	for _, node := range nodes[1:] {
+		if _, err := node.LocalFindValue(key); err == nil {
+			t.Errorf("%s still serves an expired value", node.NodeID.AsString())
+		}
+		if v := node.ExpireValues(); v != 1 {
+			t.Errorf("Was %v values expired, but expected 1", v)
+		}
+	}
+}
+
+func TestStoreAlreadyExpired(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 2)
+	key := NewRandomID()
+	sv := StoredValue{Value: []byte("old"), Publisher: nodes[0].NodeID,
+		PublishedAt: clock.Now().Add(-25 * time.Hour), ExpiresAt: clock.Now().Add(-time.Hour)}
+	if err := nodes[0].sendStore(context.Background(), &nodes[1].SelfContact, key, sv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[1].LocalFindValue(key); err == nil {
+		t.Error("an expired value was stored")
+	}
+}
+
+func TestStoreFuturePublication(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 2)
+	key := NewRandomID()
+	sv := StoredValue{Value: []byte("forever"), Publisher: nodes[0].NodeID,
+		PublishedAt: clock.Now().Add(365 * 24 * time.Hour)}
+	if err := nodes[0].sendStore(context.Background(), &nodes[1].SelfContact, key, sv); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(nodes[1].ExpireInterval)
+	if _, err := nodes[1].LocalFindValue(key); err == nil {
+		t.Error("a value published in the future outlived ExpireInterval")
+	}
+}
+
+func TestCacheAlongLookupPath(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 6)
+	ctx := context.Background()
+	key := NewRandomID()
+	byDistance := make([]Contact, len(nodes))
+	for i, node := range nodes {
+		byDistance[i] = node.SelfContact
+	}
+	sortByDistance(byDistance, key)
+	byID := make(map[ID]*Kademlia)
+	for _, node := range nodes {
+		byID[node.NodeID] = node
+	}
+	holder, reader := byID[byDistance[0].NodeID], byID[byDistance[len(nodes)-1].NodeID]
+	if err := reader.DoStore(ctx, &holder.SelfContact, key, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the others answer the lookup before the holder does
+	network := reader.Transport.(*memTransport).network
+	network.SetDelay(HostAndPortString(holder.SelfContact.Host, holder.SelfContact.Port), 50*time.Millisecond)
+	if _, _, err := reader.DoIterativeFindValue(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	cached := 0
+	for i, c := range byDistance[1:] {
+		sv, ok, _ := byID[c.NodeID].findLocal(key)
+		if !ok {
+			continue
+		}
+		cached++
+		if !sv.Cached {
+			t.Errorf("%s holds a copy which is not marked as cached", c.NodeID.AsString())
+		}
+		// the i+1 nodes closer to key each halve its life
+		if want := clock.Now().Add(cacheTTL(holder.ExpireInterval, i+1)); !sv.ExpiresAt.Equal(want) {
+			t.Errorf("Was %v, but expected %v", sv.ExpiresAt, want)
+		}
+		clock.Advance(holder.RepublishInterval)
+		if v := byID[c.NodeID].RepublishValues(ctx); v != 0 {
+			t.Errorf("Was %v values republished, but expected the cached copy not to be", v)
+		}
+	}
+	if cached != 1 {
+		t.Errorf("Was %v cached copies, but expected 1", cached)
+	}
+
+	// a cached copy never replaces the real one
+	sv, _, _ := holder.findLocal(key)
+	sv.Cached, sv.ExpiresAt = true, clock.Now().Add(time.Minute)
+	if err := reader.sendStore(ctx, &holder.SelfContact, key, sv); err != nil {
+		t.Fatal(err)
+	}
+	if sv, _, _ := holder.findLocal(key); sv.Cached {
+		t.Error("the holder's copy was replaced by a cached one")
+	}
+}
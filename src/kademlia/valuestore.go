@@ -0,0 +1,67 @@
+package kademlia
+
+// Contains the ValueStore abstraction behind Kademlia.Values, and its
+// in-memory implementation. See filestore.go for the on-disk one.
+
+import (
+	"sync"
+)
+
+// A ValueStore keeps the values a node stores for the network, with their
+// metadata. Implementations must be safe for concurrent use.
+type ValueStore interface {
+	Put(key ID, sv StoredValue) error
+	// ok is false when nothing is stored under key.
+	Get(key ID) (sv StoredValue, ok bool, err error)
+	Delete(key ID) error
+	// Call fn for every stored value until it returns false. fn must not
+	// call back into the store.
+	Iterate(fn func(key ID, sv StoredValue) bool) error
+	Close() error
+}
+
+// MemValueStore is the default ValueStore. Everything is lost on restart.
+type MemValueStore struct {
+	Locker *sync.Mutex
+	Values map[ID]StoredValue
+}
+
+func NewMemValueStore() *MemValueStore {
+	return &MemValueStore{&sync.Mutex{}, make(map[ID]StoredValue)}
+}
+
+func (s *MemValueStore) Put(key ID, sv StoredValue) error {
+	s.Locker.Lock()
+	s.Values[key] = sv
+	s.Locker.Unlock()
+	return nil
+}
+
+func (s *MemValueStore) Get(key ID) (StoredValue, bool, error) {
+	s.Locker.Lock()
+	sv, ok := s.Values[key]
+	s.Locker.Unlock()
+	return sv, ok, nil
+}
+
+func (s *MemValueStore) Delete(key ID) error {
+	s.Locker.Lock()
+	delete(s.Values, key)
+	s.Locker.Unlock()
+	return nil
+}
+
+func (s *MemValueStore) Iterate(fn func(key ID, sv StoredValue) bool) error {
+	s.Locker.Lock()
+	defer s.Locker.Unlock()
+	for key, sv := range s.Values {
+		if !fn(key, sv) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemValueStore) Close() error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package kademlia
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testValueStore(t *testing.T, s ValueStore) {
+	key := NewRandomID()
+	sv := StoredValue{Value: []byte("hello"), Publisher: NewRandomID(),
+		PublishedAt: time.Date(2015, 5, 1, 0, 0, 0, 0, time.UTC)}
+	if err := s.Put(key, sv); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.Get(key)
+	if err != nil || !ok {
+		t.Fatalf("Get returned %v, %v", ok, err)
+	}
+	if string(got.Value) != "hello" || got.Publisher != sv.Publisher || !got.PublishedAt.Equal(sv.PublishedAt) {
+		t.Errorf("Was %+v, but expected %+v", got, sv)
+	}
+
+	count := 0
+	s.Iterate(func(k ID, v StoredValue) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("Was %v values iterated, but expected 1", count)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get(key); ok {
+		t.Error("value still there after Delete")
+	}
+}
+
+func TestMemValueStore(t *testing.T) {
+	testValueStore(t, NewMemValueStore())
+}
+
+func TestFileValueStore(t *testing.T) {
+	s, err := NewFileValueStore(filepath.Join(t.TempDir(), "values.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testValueStore(t, s)
+}
+
+func TestFileValueStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, _ := NewFileValueStore(path)
+	kept, deleted := NewRandomID(), NewRandomID()
+	s.Put(kept, StoredValue{Value: []byte("kept")})
+	s.Put(deleted, StoredValue{Value: []byte("deleted")})
+	s.Delete(deleted)
+	s.Close()
+
+	// a crash in the middle of a write leaves a torn record behind
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 5})
+	f.Close()
+
+	s, err := NewFileValueStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sv, ok, _ := s.Get(kept); !ok || string(sv.Value) != "kept" {
+		t.Errorf("Was %q, %v, but expected %q", sv.Value, ok, "kept")
+	}
+	if _, ok, _ := s.Get(deleted); ok {
+		t.Error("a deleted value came back")
+	}
+	// the torn record is gone, so new records are readable after it
+	other := NewRandomID()
+	s.Put(other, StoredValue{Value: []byte("other")})
+	s.Close()
+	s, _ = NewFileValueStore(path)
+	defer s.Close()
+	if sv, ok, _ := s.Get(other); !ok || string(sv.Value) != "other" {
+		t.Errorf("Was %q, %v, but expected %q", sv.Value, ok, "other")
+	}
+}
+
+func TestFileValueStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, _ := NewFileValueStore(path)
+	key := NewRandomID()
+	for i := 0; i < 3*compactMinCount; i++ {
+		if err := s.Put(key, StoredValue{Value: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	if s.records >= compactMinCount {
+		t.Errorf("Was %v records in the log, expected it to be compacted", s.records)
+	}
+	s, _ = NewFileValueStore(path)
+	defer s.Close()
+	if sv, ok, _ := s.Get(key); !ok || string(sv.Value) != strconv.Itoa(3*compactMinCount-1) {
+		t.Errorf("Was %q, %v after compaction", sv.Value, ok)
+	}
+}
@@ -1,40 +1,90 @@
 package kademlia
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	mathrand "math/rand"
 	"sss"
-	"time"
+	"sync"
 )
 
+var (
+	// ErrSharesNotPlaced is returned when vanishing data could not store
+	// every key share in the DHT.
+	ErrSharesNotPlaced = errors.New("key shares not placed")
+	// ErrVanished is returned, as a *VanishedError, when too few key shares
+	// of a VDO are left in the DHT to recover its data.
+	ErrVanished = errors.New("VDO has vanished")
+	// ErrCorrupted is returned when the data of a VDO fails authentication:
+	// the recovered key is wrong, or the VDO was tampered with.
+	ErrCorrupted = errors.New("wrong key or corrupted VDO")
+)
+
+type VanishedError struct {
+	Found  int // key shares found
+	Needed int // the threshold T
+}
+
+func (e *VanishedError) Error() string {
+	return fmt.Sprintf("%v: found %v of the %v key shares needed", ErrVanished, e.Found, e.Needed)
+}
+
+func (e *VanishedError) Is(target error) bool {
+	return target == ErrVanished
+}
+
+// How a VDO derives the locations of its key shares from L, and encrypts its
+// data. Only the latest version is created; the others are still decoded.
+const (
+	// L is an int64 seeding math/rand. C is AES-CFB.
+	VDOVersion0 = 0
+	// L is 256 random bits; share i lives at HMAC-SHA256(L, i), truncated
+	// to an ID. C is AES-CFB.
+	VDOVersion1 = 1
+	// As VDOVersion1, but C is AES-GCM with the VDO header as associated
+	// data, so a wrong key or any tampering is detected.
+	VDOVersion2 = 2
+
+	accessKeySize = 32 // bytes of L from VDOVersion1 on
+	cryptoKeySize = 32 // bytes of K
+)
+
+// The key K is split into N shares, stored in the DHT at the locations
+// derived from L. Any T of them recover K; once the DHT has forgotten them,
+// the data is gone.
 type VanashingDataObject struct {
 	// comments by haomin
-	AccessKey  int64  // L in project description
+	AccessKey  int64  // L in project description, in VDOVersion0
 	Ciphertext []byte // C
 	NumberKeys byte   // N
 	Threshold  byte   // T
 
-	// a local copy of N pieces for testing purpose, by haomin
-	LocalCopy [][]byte // 1~N as key, pieces of byte arrays as value
+	Version         byte   // VDOVersion0 for VDOs made before there were versions
+	SecureAccessKey []byte // L, from VDOVersion1 on
 }
 
-func GenerateRandomCryptoKey() (ret []byte) { // return K
-	for i := 0; i < 32; i++ {
-		ret = append(ret, uint8(mathrand.Intn(256)))
-	}
+func GenerateRandomCryptoKey() (ret []byte, err error) { // return K
+	ret = make([]byte, cryptoKeySize)
+	_, err = io.ReadFull(rand.Reader, ret)
 	return
 }
 
-func GenerateRandomAccessKey() (accessKey int64) { // return L
-	r := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
-	accessKey = r.Int63()
+func GenerateRandomAccessKey() (accessKey []byte, err error) { // return L
+	accessKey = make([]byte, accessKeySize)
+	_, err = io.ReadFull(rand.Reader, accessKey)
 	return
 }
 
+// Where the shares of a VDOVersion0 VDO live. Anyone who can guess L, which
+// has little entropy, can find them: do not use for new VDOs.
 func CalculateSharedKeyLocations(accessKey int64, count int64) (ids []ID) {
 	r := mathrand.New(mathrand.NewSource(accessKey))
 	ids = make([]ID, count)
@@ -46,95 +96,231 @@ func CalculateSharedKeyLocations(accessKey int64, count int64) (ids []ID) {
 	return
 }
 
-func encrypt(key []byte, text []byte) (ciphertext []byte) {
+// Where the shares of a VDOVersion1 VDO live: HMAC-SHA256(L, i) for share
+// i, as a 4-byte big-endian index, truncated to an ID.
+func DeriveShareLocations(accessKey []byte, count int) []ID {
+	ids := make([]ID, count)
+	var index [4]byte
+	for i := range ids {
+		mac := hmac.New(sha256.New, accessKey)
+		binary.BigEndian.PutUint32(index[:], uint32(i))
+		mac.Write(index[:])
+		copy(ids[i][:], mac.Sum(nil))
+	}
+	return ids
+}
+
+// Return where the N key shares of vdo live, according to its version.
+func (vdo *VanashingDataObject) ShareLocations() ([]ID, error) {
+	switch vdo.Version {
+	case VDOVersion0:
+		return CalculateSharedKeyLocations(vdo.AccessKey, int64(vdo.NumberKeys)), nil
+	case VDOVersion1, VDOVersion2:
+		if len(vdo.SecureAccessKey) != accessKeySize {
+			return nil, fmt.Errorf("VDO access key is %v bytes, expected %v", len(vdo.SecureAccessKey), accessKeySize)
+		}
+		return DeriveShareLocations(vdo.SecureAccessKey, int(vdo.NumberKeys)), nil
+	}
+	return nil, fmt.Errorf("unknown VDO version %v", vdo.Version)
+}
+
+// The fields of vdo which its ciphertext is bound to from VDOVersion2 on:
+// version, N, T and L.
+func (vdo *VanashingDataObject) header() []byte {
+	header := []byte{vdo.Version, vdo.NumberKeys, vdo.Threshold}
+	return append(header, vdo.SecureAccessKey...)
+}
+
+// Encrypt text with AES-GCM under key, authenticating header with it. The
+// random nonce goes first.
+func seal(key []byte, header []byte, text []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(text)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, text, header), nil
+}
+
+// Undo seal. Fails with ErrCorrupted unless key, header and ciphertext are
+// exactly those sealed.
+func open(key []byte, header []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrCorrupted)
+	}
+	text, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return text, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AES-CFB, as used before VDOVersion2. Nothing tells a wrong key from the
+// right one: do not use for new VDOs.
+func encrypt(key []byte, text []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	ciphertext = make([]byte, aes.BlockSize+len(text))
+	ciphertext := make([]byte, aes.BlockSize+len(text))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
+		return nil, err
 	}
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], text)
-	return
+	return ciphertext, nil
 }
 
-func decrypt(key []byte, ciphertext []byte) (text []byte) {
+func decrypt(key []byte, ciphertext []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if len(ciphertext) < aes.BlockSize {
-		panic("ciphertext is not long enough")
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrCorrupted)
 	}
 	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	text := make([]byte, len(ciphertext)-aes.BlockSize)
 
 	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
-	return ciphertext
+	stream.XORKeyStream(text, ciphertext[aes.BlockSize:])
+	return text, nil
+}
+
+// Decrypt the data of vdo with K, as its version says.
+func (vdo *VanashingDataObject) decrypt(K []byte) ([]byte, error) {
+	if vdo.Version >= VDOVersion2 {
+		return open(K, vdo.header(), vdo.Ciphertext)
+	}
+	return decrypt(K, vdo.Ciphertext)
 }
 
-func VanishData(kadem Kademlia, data []byte, numberKeys byte,
-	threshold byte) (vdo VanashingDataObject) {
-	K := GenerateRandomCryptoKey()
-	C := encrypt(K, data)
+// Encrypt data under a fresh key and push the key's shares into the DHT. It
+// fails with ErrSharesNotPlaced unless all N shares were stored.
+func VanishData(ctx context.Context, kadem *Kademlia, data []byte, numberKeys byte,
+	threshold byte) (vdo VanashingDataObject, err error) {
+	if threshold > numberKeys { // the data could never be recovered
+		return vdo, fmt.Errorf("threshold %v of %v key shares", threshold, numberKeys)
+	}
+	K, err := GenerateRandomCryptoKey()
+	if err != nil {
+		return
+	}
 	N := numberKeys
 	T := threshold
 	shares, err := sss.Split(N, T, K)
 	if err != nil {
-		fmt.Printf("err!!!!")
-		panic(err)
+		return
+	}
+	L, err := GenerateRandomAccessKey()
+	if err != nil {
+		return
+	}
+	vdo = VanashingDataObject{NumberKeys: N, Threshold: T,
+		Version: VDOVersion2, SecureAccessKey: L}
+	if vdo.Ciphertext, err = seal(K, vdo.header(), data); err != nil {
+		return
+	}
+	indices, err := vdo.ShareLocations() // where the key pieces to be stored
+	if err != nil {
+		return
 	}
-	L := GenerateRandomAccessKey()
-	lc := make([][]byte, int(N))
-	vdo = VanashingDataObject{L, C, N, T, lc}
-	//indices := CalculateSharedKeyLocations(L, int64(N)) // where the key pieces to be stored
+
+	errs := make([]error, N)
+	var wg sync.WaitGroup
 	for k := 0; k < int(N); k++ {
-		tmp_k := []byte{byte(k + 1)}
-		tmp_v := shares[byte(k+1)]
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			// a share is stored as its x coordinate followed by its bytes
+			all := append([]byte{byte(k + 1)}, shares[byte(k+1)]...)
+			_, errs[k] = kadem.DoIterativeStore(ctx, indices[k], all)
+		}(k)
+	}
+	wg.Wait()
 
-		all := append(tmp_k, tmp_v...)
-		lc[k] = all
-		//fmt.Printf("debugging")
-		//(&kadem).DoIterativeStore(indices[k], all)
+	placed := 0
+	var lastErr error
+	for _, e := range errs {
+		if e == nil {
+			placed++
+		} else {
+			lastErr = e
+		}
 	}
-	return
+	if placed < int(N) {
+		return VanashingDataObject{}, fmt.Errorf("%w: %v of %v: %v", ErrSharesNotPlaced, placed, N, lastErr)
+	}
+	return vdo, nil
 }
 
-func UnvanishData(kadem Kademlia, vdo VanashingDataObject) (data []byte) {
-	//L := vdo.AccessKey
-	C := vdo.Ciphertext
+// Look up the N key shares of vdo in the DHT all at once, and decrypt its
+// data as soon as T of them arrived. Fails with a *VanishedError when fewer
+// than T are left, and with ErrCorrupted when they do not give the right key.
+// A value which cannot be the share stored at its location, as any DHT node
+// may send us, counts as no share at all.
+func UnvanishData(ctx context.Context, kadem *Kademlia, vdo VanashingDataObject) (data []byte, err error) {
 	N := vdo.NumberKeys
 	T := vdo.Threshold
-	//indices := CalculateSharedKeyLocations(L, int64(N)) // where the key pieces are stored
+	indices, err := vdo.ShareLocations() // where the key pieces are stored
+	if err != nil {
+		return nil, err
+	}
+
+	lookupCtx, cancel := context.WithCancel(ctx)
+	found := make(chan []byte, N) // buffered so no lookup blocks once we stop
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for k := 0; k < int(N); k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			all, _, err := kadem.DoIterativeFindValue(lookupCtx, indices[k])
+			// share k is stored as its x coordinate, k+1, followed by one
+			// byte per byte of K
+			if err != nil || len(all) != 1+cryptoKeySize || all[0] != byte(k+1) {
+				all = nil
+			}
+			found <- all
+		}(k)
+	}
 
 	count := 0
 	shares := make(map[byte][]byte, T) // the pieces we need to re-construct our key
-
-	for k := 0; k < int(N); k++ {
-		//Bytes, Contacts := (&kadem).DoIterativeFindValue_Internal(indices[k])
-		//if len(Contacts) == 0 { // nothing found :-(
-		//	continue
-		//}
-		fmt.Printf("%v\n", k)
-		Bytes := vdo.LocalCopy[k]
-
-		all := Bytes
-		tmp_k := all[0]
-		tmp_v := all[1:]
-		shares[tmp_k] = tmp_v
+	for k := 0; k < int(N) && count < int(T); k++ {
+		all := <-found
+		if all == nil { // nothing found :-(
+			continue
+		}
+		shares[all[0]] = all[1:]
 		count++
-		//if count >= int(T) {
-		//	break
-		//}
 	}
 	if count >= int(T) { // enough!
 		K := sss.Combine(shares)
-		return decrypt(K, C)
-	} else { // failed to collect enough pieces
-		return []byte("not enough!!!")
+		return vdo.decrypt(K)
+	}
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
 	}
+	// failed to collect enough pieces
+	return nil, &VanishedError{count, int(T)}
 }
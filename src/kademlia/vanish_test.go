@@ -0,0 +1,192 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"sss"
+	"testing"
+	"time"
+)
+
+func TestVanishAndUnvanish(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 8)
+	ctx := context.Background()
+	vdoID := NewRandomID()
+	if err := nodes[0].DoVanish(ctx, vdoID, []byte("secret"), 5, 3); err != nil {
+		t.Fatal(err)
+	}
+	data, err := nodes[3].DoUnvanish(ctx, &nodes[0].SelfContact, vdoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("Was %q, but expected %q", data, "secret")
+	}
+
+	// once the shares expire, the data is gone
+	clock.Advance(nodes[0].ExpireInterval)
+	for _, node := range nodes {
+		node.ExpireValues()
+	}
+	var vanished *VanishedError
+	_, err = nodes[3].DoUnvanish(ctx, &nodes[0].SelfContact, vdoID)
+	if !errors.Is(err, ErrVanished) || !errors.As(err, &vanished) {
+		t.Fatalf("Was %v, but expected %v", err, ErrVanished)
+	}
+	if vanished.Found != 0 || vanished.Needed != 3 {
+		t.Errorf("Was %+v, but expected 0 of 3 shares found", vanished)
+	}
+}
+
+func TestVanishNowhereToPlaceShares(t *testing.T) {
+	network := NewMemNetwork()
+	alone, _ := network.NewKademlia("127.0.0.1:0")
+	err := alone.DoVanish(context.Background(), NewRandomID(), []byte("secret"), 5, 3)
+	if !errors.Is(err, ErrSharesNotPlaced) {
+		t.Errorf("Was %v, but expected %v", err, ErrSharesNotPlaced)
+	}
+}
+
+func TestVanishThresholdAboveN(t *testing.T) {
+	nodes, _ := newMeshNetwork(t, 8)
+	if _, err := VanishData(context.Background(), nodes[0], []byte("secret"), 3, 5); err == nil {
+		t.Error("vanished data which could never be recovered")
+	}
+}
+
+func TestUnvanishFromThresholdShares(t *testing.T) {
+	nodes, _ := newMeshNetwork(t, 8)
+	ctx := context.Background()
+	vdo, err := VanishData(ctx, nodes[0], []byte("secret"), 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only 3 shares are left
+	locations, _ := vdo.ShareLocations()
+	for _, location := range locations[:7] {
+		for _, node := range nodes {
+			node.Values.Delete(location)
+		}
+	}
+	data, err := UnvanishData(ctx, nodes[5], vdo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("Was %q, but expected %q", data, "secret")
+	}
+}
+
+func TestUnvanishBogusShares(t *testing.T) {
+	nodes, clock := newMeshNetwork(t, 8)
+	ctx := context.Background()
+	vdo, err := VanishData(ctx, nodes[0], []byte("secret"), 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a truncated share, and a share stored at the wrong location
+	locations, _ := vdo.ShareLocations()
+	truncated := StoredValue{Value: []byte{1, 2, 3, 4, 5}, PublishedAt: clock.Now(), ExpiresAt: clock.Now().Add(time.Hour)}
+	for _, node := range nodes {
+		moved, _, _ := node.findLocal(locations[4])
+		node.Values.Put(locations[0], truncated)
+		node.Values.Put(locations[1], moved)
+		node.Values.Delete(locations[2])
+	}
+	var vanished *VanishedError
+	if _, err := UnvanishData(ctx, nodes[5], vdo); !errors.As(err, &vanished) {
+		t.Fatalf("Was %v, but expected %v", err, ErrVanished)
+	}
+	if vanished.Found != 2 {
+		t.Errorf("Was %v shares found, but expected %v", vanished.Found, 2)
+	}
+}
+
+func TestShareLocationsV1(t *testing.T) {
+	key := make([]byte, accessKeySize)
+	a := DeriveShareLocations(key, 4)
+	if b := DeriveShareLocations(key, 4); a[3] != b[3] {
+		t.Error("share locations are not deterministic")
+	}
+	key[0] = 1
+	if b := DeriveShareLocations(key, 4); a[0] == b[0] {
+		t.Error("different access keys gave the same share location")
+	}
+	if a[0] == a[1] {
+		t.Error("two shares got the same location")
+	}
+}
+
+// A VDO made before VDOs had versions still unvanishes.
+func TestUnvanishVersion0(t *testing.T) {
+	nodes, _ := newMeshNetwork(t, 6)
+	ctx := context.Background()
+	K, _ := GenerateRandomCryptoKey()
+	C, err := encrypt(K, []byte("old secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdo := VanashingDataObject{AccessKey: 42, Ciphertext: C, NumberKeys: 4, Threshold: 2}
+	shares, err := sss.Split(4, 2, K)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range CalculateSharedKeyLocations(42, 4) {
+		share := append([]byte{byte(i + 1)}, shares[byte(i+1)]...)
+		if _, err := nodes[0].DoIterativeStore(ctx, location, share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := UnvanishData(ctx, nodes[3], vdo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old secret" {
+		t.Errorf("Was %q, but expected %q", data, "old secret")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key, _ := GenerateRandomCryptoKey()
+	other, _ := GenerateRandomCryptoKey()
+	header := []byte{VDOVersion2, 5, 3}
+	sealed, err := seal(key, header, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := open(key, header, sealed); err != nil || string(text) != "secret" {
+		t.Errorf("Was %q, %v, but expected %q", text, err, "secret")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name       string
+		key        []byte
+		header     []byte
+		ciphertext []byte
+	}{
+		{"wrong key", other, header, sealed},
+		{"other header", key, []byte{VDOVersion2, 5, 2}, sealed},
+		{"tampered ciphertext", key, header, tampered},
+		{"short ciphertext", key, header, sealed[:4]},
+	}
+	for _, test := range tests {
+		if _, err := open(test.key, test.header, test.ciphertext); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: Was %v, but expected %v", test.name, err, ErrCorrupted)
+		}
+	}
+}
+
+func TestUnvanishTampered(t *testing.T) {
+	nodes, _ := newMeshNetwork(t, 6)
+	ctx := context.Background()
+	vdo, err := VanishData(ctx, nodes[0], []byte("secret"), 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdo.Ciphertext[len(vdo.Ciphertext)-1] ^= 1
+	if data, err := UnvanishData(ctx, nodes[3], vdo); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Was %q, %v, but expected %v", data, err, ErrCorrupted)
+	}
+}
@@ -0,0 +1,154 @@
+package kademlia
+
+// Contains the portable encodings of a VDO, so that it can be kept in a file
+// or sent by email. The binary encoding is, all integers big-endian:
+//
+//	"VDO" magic, then format version 1    4 bytes
+//	VDO version                           1 byte
+//	cipher suite                          1 byte
+//	N, T                                  1 byte each
+//	access key length, access key         2 bytes, then that many
+//	ciphertext length, ciphertext         4 bytes, then that many
+//
+// A VDOVersion0 access key is its int64, as 8 bytes. The armored encoding is
+// the binary one in a PEM block.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBadVDO is returned when decoding something that is not a VDO.
+var ErrBadVDO = errors.New("malformed VDO")
+
+const (
+	vdoMagic         = "VDO"
+	vdoFormatVersion = 1
+	vdoPEMType       = "VANISHING DATA OBJECT"
+)
+
+// The cipher suites a VDO's data can be encrypted with.
+const (
+	CipherAES256CFB = 1
+	CipherAES256GCM = 2
+)
+
+// Return the cipher suite of vdo's version.
+func (vdo *VanashingDataObject) CipherSuite() byte {
+	if vdo.Version >= VDOVersion2 {
+		return CipherAES256GCM
+	}
+	return CipherAES256CFB
+}
+
+func (vdo *VanashingDataObject) accessKeyBytes() []byte {
+	if vdo.Version == VDOVersion0 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(vdo.AccessKey))
+		return key
+	}
+	return vdo.SecureAccessKey
+}
+
+// Return the binary encoding of vdo.
+func EncodeVDO(vdo VanashingDataObject) ([]byte, error) {
+	if vdo.Version > VDOVersion2 {
+		return nil, fmt.Errorf("unknown VDO version %v", vdo.Version)
+	}
+	key := vdo.accessKeyBytes()
+	if len(key) > 0xffff || uint64(len(vdo.Ciphertext)) > 0xffffffff {
+		return nil, errors.New("VDO too large to encode")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(vdoMagic)
+	buf.WriteByte(vdoFormatVersion)
+	buf.Write([]byte{vdo.Version, vdo.CipherSuite(), vdo.NumberKeys, vdo.Threshold})
+	binary.Write(&buf, binary.BigEndian, uint16(len(key)))
+	buf.Write(key)
+	binary.Write(&buf, binary.BigEndian, uint32(len(vdo.Ciphertext)))
+	buf.Write(vdo.Ciphertext)
+	return buf.Bytes(), nil
+}
+
+// Undo EncodeVDO. Fails with ErrBadVDO on anything else.
+func DecodeVDO(data []byte) (vdo VanashingDataObject, err error) {
+	r := bytes.NewReader(data)
+	var fixed struct {
+		Magic         [3]byte
+		FormatVersion byte
+		Version       byte
+		CipherSuite   byte
+		NumberKeys    byte
+		Threshold     byte
+		KeyLength     uint16
+	}
+	if err = binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return vdo, fmt.Errorf("%w: truncated header", ErrBadVDO)
+	}
+	if string(fixed.Magic[:]) != vdoMagic || fixed.FormatVersion != vdoFormatVersion {
+		return vdo, fmt.Errorf("%w: not a version %v VDO encoding", ErrBadVDO, vdoFormatVersion)
+	}
+	vdo.Version, vdo.NumberKeys, vdo.Threshold = fixed.Version, fixed.NumberKeys, fixed.Threshold
+	if vdo.Version > VDOVersion2 {
+		return vdo, fmt.Errorf("%w: unknown VDO version %v", ErrBadVDO, vdo.Version)
+	}
+	if fixed.CipherSuite != vdo.CipherSuite() {
+		return vdo, fmt.Errorf("%w: cipher suite %v in a version %v VDO", ErrBadVDO, fixed.CipherSuite, vdo.Version)
+	}
+	if vdo.Threshold < 2 || vdo.Threshold > vdo.NumberKeys {
+		return vdo, fmt.Errorf("%w: threshold %v of %v key shares", ErrBadVDO, vdo.Threshold, vdo.NumberKeys)
+	}
+
+	key := make([]byte, fixed.KeyLength)
+	if _, err = io.ReadFull(r, key); err != nil {
+		return vdo, fmt.Errorf("%w: truncated access key", ErrBadVDO)
+	}
+	if vdo.Version == VDOVersion0 {
+		if len(key) != 8 {
+			return vdo, fmt.Errorf("%w: version 0 access key is %v bytes", ErrBadVDO, len(key))
+		}
+		vdo.AccessKey = int64(binary.BigEndian.Uint64(key))
+	} else {
+		vdo.SecureAccessKey = key
+	}
+
+	var length uint32
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return vdo, fmt.Errorf("%w: truncated ciphertext length", ErrBadVDO)
+	}
+	if uint64(length) != uint64(r.Len()) {
+		return vdo, fmt.Errorf("%w: ciphertext is %v bytes, expected %v", ErrBadVDO, r.Len(), length)
+	}
+	vdo.Ciphertext = make([]byte, length)
+	_, err = io.ReadFull(r, vdo.Ciphertext)
+	return vdo, err
+}
+
+// Return the ASCII-armored encoding of vdo.
+func ArmorVDO(vdo VanashingDataObject) ([]byte, error) {
+	data, err := EncodeVDO(vdo)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: vdoPEMType, Bytes: data}), nil
+}
+
+// Decode a VDO in either encoding.
+func ParseVDO(data []byte) (VanashingDataObject, error) {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte("-----BEGIN ")) {
+		return DecodeVDO(data)
+	}
+	block, rest := pem.Decode(trimmed)
+	if block == nil || block.Type != vdoPEMType {
+		return VanashingDataObject{}, fmt.Errorf("%w: no %v block", ErrBadVDO, vdoPEMType)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return VanashingDataObject{}, fmt.Errorf("%w: trailing data after the armor", ErrBadVDO)
+	}
+	return DecodeVDO(block.Bytes)
+}
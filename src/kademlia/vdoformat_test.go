@@ -0,0 +1,62 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestVDOEncodings(t *testing.T) {
+	vdos := []VanashingDataObject{
+		{AccessKey: -42, Ciphertext: []byte("old"), NumberKeys: 5, Threshold: 3},
+		{Version: VDOVersion2, SecureAccessKey: bytes.Repeat([]byte{7}, accessKeySize),
+			Ciphertext: []byte("new"), NumberKeys: 10, Threshold: 4},
+	}
+	for _, vdo := range vdos {
+		data, err := EncodeVDO(vdo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		armored, err := ArmorVDO(vdo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, encoded := range [][]byte{data, armored} {
+			decoded, err := ParseVDO(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, vdo) {
+				t.Errorf("Was %+v, but expected %+v", decoded, vdo)
+			}
+		}
+	}
+}
+
+func TestDecodeBadVDO(t *testing.T) {
+	vdo := VanashingDataObject{Version: VDOVersion2, SecureAccessKey: make([]byte, accessKeySize),
+		Ciphertext: []byte("data"), NumberKeys: 5, Threshold: 3}
+	data, _ := EncodeVDO(vdo)
+	suite := append([]byte(nil), data...)
+	suite[5] = CipherAES256CFB
+	noThreshold := append([]byte(nil), data...)
+	noThreshold[7] = 0
+	tooHigh := append([]byte(nil), data...)
+	tooHigh[7] = 6
+	inputs := map[string][]byte{
+		"empty":        nil,
+		"not a VDO":    []byte("hello, world"),
+		"truncated":    data[:len(data)-1],
+		"trailing":     append(append([]byte(nil), data...), 0),
+		"cipher suite": suite,
+		"T of 0":       noThreshold,
+		"T above N":    tooHigh,
+		"bad armor":    []byte("-----BEGIN SOMETHING ELSE-----\n-----END SOMETHING ELSE-----\n"),
+	}
+	for name, input := range inputs {
+		if _, err := ParseVDO(input); !errors.Is(err, ErrBadVDO) {
+			t.Errorf("%s: Was %v, but expected %v", name, err, ErrBadVDO)
+		}
+	}
+}
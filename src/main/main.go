@@ -4,12 +4,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
-	"net/rpc"
 	"os"
 	"strconv"
 	"strings"
@@ -27,36 +28,93 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	// Get the bind and connect connection strings from command-line arguments.
+	valuesPath := flag.String("values", "", "keep stored values in this file instead of in memory")
+	dataDir := flag.String("datadir", "", "keep the node ID, routing table and values in this directory across restarts")
+	writeQuorum := flag.Int("write-quorum", 1, "how many nodes must acknowledge an iterativeStore")
+	readQuorum := flag.Int("read-quorum", 1, "how many holders an iterativeFindValue asks for the value")
+	resolver := flag.String("resolver", "majority", "how to settle disagreeing holders: majority, newest or hash")
+	latencyAware := flag.Bool("latency-aware", false, "let lookups prefer faster contacts among equally close ones")
+	armor := flag.Bool("armor", false, "write VDOs ASCII-armored instead of binary")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] listen firstPeer [vanish N T [in [out]] | unvanish [in [out]]]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "A missing file or - is stdin or stdout.\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatal("Must be invoked with exactly two arguments!\n")
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
 	}
 	listenStr := args[0]
 	firstPeerStr := args[1]
+	oneShot := args[2:]
+	// where we tell the user how things go; a one-shot command keeps stdout
+	// for its result
+	console := os.Stdout
+	if len(oneShot) > 0 {
+		if err := checkOneShot(oneShot); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		console = os.Stderr
+	}
+
+	if *writeQuorum < 1 || *readQuorum < 1 {
+		log.Fatal("-write-quorum and -read-quorum must be at least 1")
+	}
 
 	// Create the Kademlia instance
-	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia(listenStr)
-
-	// Confirm our server is up with a PING request and then exit.
-	// Your code should loop forever, reading instructions from stdin and
-	// printing their results to stdout. See README.txt for more details.
-	//client, err := rpc.DialHTTP("tcp", firstPeerStr)
-	_, err := rpc.DialHTTP("tcp", firstPeerStr)
+	fmt.Fprintf(console, "kademlia starting up!\n")
+	cfg := kademlia.Config{DataDir: *dataDir}
+	if *valuesPath != "" {
+		values, err := kademlia.NewFileValueStore(*valuesPath)
+		if err != nil {
+			log.Fatal("NewFileValueStore: ", err)
+		}
+		cfg.Values = values
+	}
+	cfg.LatencyAware = *latencyAware
+	cfg.WriteQuorum = *writeQuorum
+	cfg.ReadQuorum = *readQuorum
+	switch *resolver {
+	case "majority":
+		cfg.Resolver = kademlia.MajorityResolver{}
+	case "newest":
+		cfg.Resolver = kademlia.NewestResolver{}
+	case "hash":
+		cfg.Resolver = kademlia.HashResolver{}
+	default:
+		log.Fatal("Unknown resolver: ", *resolver)
+	}
+	kadem, err := kademlia.NewKademliaWithConfig(listenStr, cfg)
+	if err != nil {
+		log.Fatal("NewKademlia: ", err)
+	}
+	fmt.Fprintf(console, "Self Id: %s\n", kadem.NodeID.AsString())
+
+	// Rejoin through the contacts of our last run if we have any, otherwise
+	// join through the first peer. The very first node of a network has
+	// nobody to join, so a failure is not fatal.
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	err = kadem.Rejoin(ctx)
+	if err != nil {
+		err = kadem.Bootstrap(ctx, firstPeerStr)
+	}
+	cancel()
 	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+		log.Printf("Bootstrap: %v\n", err)
 	}
 
-	//ping := new(kademlia.PingMessage)
-	//ping.MsgID = kademlia.NewRandomID()
-	//var pong kademlia.PongMessage
-	//err = client.Call("KademliaCore.Ping", ping, &pong)
-	//if err != nil {
-	//	log.Fatal("Call: ", err)
-	//}
-	//log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	//log.Printf("pong msgID: %s\n", pong.MsgID.AsString())
+	if len(oneShot) > 0 {
+		err := runOneShot(kadem, oneShot, *armor)
+		kadem.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	in := bufio.NewReader(os.Stdin)
 	quit := false
@@ -76,9 +134,104 @@ func main() {
 			fmt.Printf("%v\n", resp)
 		}
 	}
+	kadem.Close()
+}
+
+// how long a single command may run before it is abandoned
+const commandTimeout = 30 * time.Second
+
+// Check the arguments of a one-shot command before joining the network.
+func checkOneShot(args []string) error {
+	switch {
+	case args[0] == "vanish" && len(args) >= 3 && len(args) <= 5:
+		if _, err := parseByte(args[1]); err != nil {
+			return fmt.Errorf("invalid N (%v)", args[1])
+		}
+		if _, err := parseByte(args[2]); err != nil {
+			return fmt.Errorf("invalid T (%v)", args[2])
+		}
+		return nil
+	case args[0] == "unvanish" && len(args) <= 3:
+		return nil
+	}
+	return fmt.Errorf("unknown command: %v", strings.Join(args, " "))
+}
+
+func parseByte(s string) (byte, error) {
+	n, err := strconv.ParseUint(s, 10, 8)
+	return byte(n), err
+}
+
+// Run a one-shot vanish or unvanish, as checked by checkOneShot: vanish
+// reads data and writes its VDO, unvanish reads a VDO in either encoding
+// and writes its data.
+func runOneShot(k *kademlia.Kademlia, args []string, armor bool) error {
+	var files []string
+	if args[0] == "vanish" {
+		files = args[3:]
+	} else {
+		files = args[1:]
+	}
+	in, out := "-", "-"
+	if len(files) > 0 {
+		in = files[0]
+	}
+	if len(files) > 1 {
+		out = files[1]
+	}
+	input, err := readInput(in)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var output []byte
+	if args[0] == "vanish" {
+		N, _ := parseByte(args[1])
+		T, _ := parseByte(args[2])
+		vdo, err := kademlia.VanishData(ctx, k, input, N, T)
+		if err != nil {
+			return err
+		}
+		if armor {
+			output, err = kademlia.ArmorVDO(vdo)
+		} else {
+			output, err = kademlia.EncodeVDO(vdo)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		vdo, err := kademlia.ParseVDO(input)
+		if err != nil {
+			return err
+		}
+		if output, err = kademlia.UnvanishData(ctx, k, vdo); err != nil {
+			return err
+		}
+	}
+	return writeOutput(out, output)
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func writeOutput(name string, data []byte) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0600)
 }
 
 func executeLine(k *kademlia.Kademlia, line string) (response string) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
 	toks := strings.Fields(line)
 	switch {
 	case toks[0] == "quit":
@@ -108,6 +261,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		response = "OK: NodeID=" + toks[1] + "\n"
 		response += "      Host=" + c.Host.String() + "\n"
 		response += "      Port=" + strconv.Itoa(int(c.Port))
+	case toks[0] == "print_stats":
+		if len(toks) > 1 {
+			response = "usage: print_stats"
+			return
+		}
+		response = "OK: " + statsString(k.ContactStats(), time.Now())
 	case toks[0] == "ping":
 		// Do a ping
 		//
@@ -144,7 +303,7 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 					break
 				}
 			}
-			response = k.DoPing(host, uint16(port))
+			response = pingResponse(k.DoPing(ctx, host, uint16(port)))
 			return
 		}
 		c, err := k.FindContact(id)
@@ -152,7 +311,7 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Not a valid Node ID or host:port address"
 			return
 		}
-		response = k.DoPing(c.Host, c.Port)
+		response = pingResponse(k.DoPing(ctx, c.Host, c.Port))
 
 	case toks[0] == "local_find_value":
 		// print a local variable
@@ -165,7 +324,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
-		response = k.LocalFindValue(key)
+		value, err := k.LocalFindValue(key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = fmt.Sprintf("OK: %s", value)
 
 	case toks[0] == "store":
 		// Store key, value pair at NodeID
@@ -190,7 +354,11 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		value := []byte(toks[3])
 
-		response = k.DoStore(contact, key, value)
+		if err := k.DoStore(ctx, contact, key, value); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: stored"
 
 	case toks[0] == "find_node":
 		// perform a find_node RPC
@@ -214,7 +382,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoFindNode(contact, key)
+		nodes, err := k.DoFindNode(ctx, contact, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: " + contactsString(nodes)
 
 	case toks[0] == "find_value":
 		// perform a find_value RPC
@@ -238,7 +411,16 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoFindValue(contact, key)
+		value, nodes, err := k.DoFindValue(ctx, contact, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		if value != nil {
+			response = fmt.Sprintf("OK: %s", value)
+		} else {
+			response = "OK: " + contactsString(nodes)
+		}
 
 	case toks[0] == "iterativeFindNode":
 		// perform an iterative find node
@@ -251,7 +433,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid node ID(" + toks[1] + ")"
 			return
 		}
-		response = k.DoIterativeFindNode(id)
+		nodes, err := k.DoIterativeFindNode(ctx, id)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: " + contactsString(nodes)
 
 	case toks[0] == "iterativeStore":
 		// perform an iterative store
@@ -264,7 +451,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoIterativeStore(key, []byte(toks[2]))
+		reports, err := k.DoIterativeStore(ctx, key, []byte(toks[2]))
+		if err != nil {
+			response = "ERR: " + err.Error() + storeReportsString(reports)
+			return
+		}
+		response = "OK: stored" + storeReportsString(reports)
 
 	case toks[0] == "iterativeFindValue":
 		// performa an iterative find value
@@ -277,7 +469,24 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
-		response = k.DoIterativeFindValue(key)
+		if k.ReadQuorum > 1 {
+			report, err := k.DoQuorumFindValue(ctx, key)
+			if err != nil {
+				response = "ERR: " + err.Error() + copiesString(report.Copies)
+				return
+			}
+			response = fmt.Sprintf("OK: %s %s", report.Holder.NodeID.AsString(), report.Value)
+			if len(report.Disagreements) > 0 {
+				response += "\n  disagreeing:" + copiesString(report.Disagreements)
+			}
+			return
+		}
+		value, contact, err := k.DoIterativeFindValue(ctx, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = fmt.Sprintf("OK: %s %s", contact.NodeID.AsString(), value)
 
 	case toks[0] == "vanish":
 		//perfom a vanish function
@@ -307,7 +516,11 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 
 		//response = k.DoVanish(key, data, numberKeys[0], threshold[0])
-		response = k.DoVanish(key, data, byte(N), byte(T))
+		if err := k.DoVanish(ctx, key, data, byte(N), byte(T)); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: vanish is done"
 
 	case toks[0] == "unvanish":
 
@@ -335,10 +548,67 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			return
 		}
 
-		response = k.DoUnvanish(contact, key_vdo)
+		data, err := k.DoUnvanish(ctx, contact, key_vdo)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = fmt.Sprintf("OK: %s", data)
 
 	default:
 		response = "ERR: Unknown command"
 	}
 	return
 }
+
+func pingResponse(c kademlia.Contact, err error) string {
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: " + c.NodeID.AsString()
+}
+
+// Format a list of contacts, one per line.
+func contactsString(contacts []kademlia.Contact) string {
+	output := fmt.Sprintf("%v nodes", len(contacts))
+	for _, c := range contacts {
+		output += "\n    " + c.NodeID.AsString() + " " + kademlia.HostAndPortString(c.Host, c.Port)
+	}
+	return output
+}
+
+// Format what each node did with an iterativeStore, one per line.
+func storeReportsString(reports []kademlia.StoreReport) string {
+	output := ""
+	for _, r := range reports {
+		status := "ok"
+		if r.Err != nil {
+			status = r.Err.Error()
+		}
+		output += "\n    " + r.Contact.NodeID.AsString() + " " + status
+	}
+	return output
+}
+
+// Format the copies of a value a quorum read found, one per line.
+func copiesString(copies []kademlia.ValueCopy) string {
+	output := ""
+	for _, c := range copies {
+		output += fmt.Sprintf("\n    %s %s", c.Holder.NodeID.AsString(), c.Value)
+	}
+	return output
+}
+
+// Format the liveness records of contacts, one per line.
+func statsString(stats []kademlia.ContactStats, now time.Time) string {
+	output := fmt.Sprintf("%v contacts", len(stats))
+	for _, s := range stats {
+		seen := "never"
+		if !s.LastSeen.IsZero() {
+			seen = now.Sub(s.LastSeen).Round(time.Second).String() + " ago"
+		}
+		output += fmt.Sprintf("\n    %s %s seen=%s rtt=%v failures=%v", s.Contact.NodeID.AsString(),
+			kademlia.HostAndPortString(s.Contact.Host, s.Contact.Port), seen, s.RTT, s.Failures)
+	}
+	return output
+}